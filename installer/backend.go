@@ -0,0 +1,228 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+)
+
+// backend is a runtime serving models to Open WebUI: ollama on the ollama port
+// (for the remote backend, through a proxy), or llama-server on its own port.
+type backend interface {
+	// Get the name of the runtime, for messages.
+	name() string
+	// Find the installed server executable; returns an empty string if it is
+	// not installed.
+	executable(ctx context.Context) string
+	// Install the runtime, unless it is already installed.
+	install(ctx context.Context) error
+	// Start the server unless it is already running, and wait for it to
+	// respond.
+	start(ctx context.Context) error
+	// Stop the server; unless forceShutdown is set, only the server started
+	// by the extension is stopped.
+	stop(ctx context.Context) (*shutdownReport, error)
+	// Check if the server is responding.
+	health(ctx context.Context) (bool, error)
+	// List the models the server can use.
+	models(ctx context.Context) ([]string, error)
+	// Get the version of the runtime.
+	version(ctx context.Context) (string, error)
+}
+
+// Get the configured backend.
+func getBackend() backend {
+	switch config.Backend {
+	case backendRemote:
+		return remoteBackend{}
+	case backendLlamaCpp:
+		return llamaCppBackend{}
+	}
+	return ollamaBackend{}
+}
+
+// Create a request to the given path on the server, with credentials for the
+// remote server if needed.
+func newServerRequest(ctx context.Context, method, path string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, method, getServerURL()+path, body)
+	if err != nil {
+		return nil, err
+	}
+	if isRemoteBackend() && config.Remote.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+config.Remote.Token)
+	}
+	return req, nil
+}
+
+// Get a JSON response from the given path on the server.
+func getServerJSON(ctx context.Context, path string, result any) error {
+	req, err := newServerRequest(ctx, http.MethodGet, path, nil)
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	resp, err := doWithRetry(ctx, req, healthRetryPolicy)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden:
+		return fmt.Errorf("%s was refused (status %s); check remote.token", path, resp.Status)
+	case resp.StatusCode >= 300:
+		return fmt.Errorf("%s returned unexpected status %s", path, resp.Status)
+	}
+	if err = json.NewDecoder(resp.Body).Decode(result); err != nil {
+		return fmt.Errorf("%s returned an invalid response: %w", path, err)
+	}
+	return nil
+}
+
+// ollamaBackend is ollama, installed and run by the extension.  An ollama
+// server that is already running (e.g. one installed separately) is used
+// instead, if there is one.
+type ollamaBackend struct{}
+
+func (ollamaBackend) name() string {
+	return "ollama"
+}
+
+func (ollamaBackend) executable(ctx context.Context) string {
+	return findExecutable(ctx, false)
+}
+
+func (ollamaBackend) install(ctx context.Context) error {
+	isRunning, err := checkExistingInstance(ctx)
+	if err != nil {
+		return err
+	}
+	if isRunning {
+		return nil
+	}
+	executablePath := findExecutable(ctx, false)
+	if executablePath == "" {
+		// If a previous executable is not found, install it to the default
+		// location.
+		installLocation, err := getDefaultInstallLocation(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to get install location: %w", err)
+		}
+		report, err := runPreflight(ctx)
+		if err != nil {
+			return err
+		}
+		report.log()
+		if err = report.err(); err != nil {
+			if !skipPreflight {
+				return err
+			}
+			log.Printf("Ignoring failed preflight checks: %s", err)
+		}
+		executablePath, asset, err := installOllama(ctx, config.Release, installLocation)
+		if err != nil {
+			return fmt.Errorf("failed to install ollama: %w", err)
+		}
+		version, err := validateExecutable(ctx, executablePath, parseOllamaVersion)
+		if err != nil {
+			if asset != nil {
+				// Don't leave an executable that cannot run, so that the
+				// next install starts afresh.
+				if removeErr := os.RemoveAll(installLocation); removeErr != nil {
+					log.Printf("Failed to remove %s: %s", installLocation, removeErr)
+				}
+			}
+			return err
+		}
+		log.Printf("Installed ollama version %s.", version)
+		if asset != nil {
+			if err = writeInstallReceipt(ctx, installLocation, asset, version); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	version, err := validateExecutable(ctx, executablePath, parseOllamaVersion)
+	if err != nil {
+		return err
+	}
+	log.Printf("Found ollama version %s at %s.", version, executablePath)
+	return nil
+}
+
+func (ollamaBackend) start(ctx context.Context) error {
+	executablePath := findExecutable(ctx, false)
+	// The remote proxy would otherwise be taken for a running ollama.
+	if err := stopOtherOwnedServer(ctx, executablePath); err != nil {
+		return err
+	}
+	isRunning, err := checkExistingInstance(ctx)
+	if err != nil {
+		return err
+	}
+	if isRunning {
+		return nil
+	}
+
+	if executablePath == "" {
+		return fmt.Errorf("failed to find ollama executable; was it installed?")
+	}
+
+	if err = startServer(ctx, executablePath); err != nil {
+		return err
+	}
+
+	// Pull the model in the background so that Open WebUI can be shown while it
+	// downloads; see ModePullStatus.
+	if len(config.Models) > 0 {
+		if err = startPullJob(ctx, config.Models); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (ollamaBackend) stop(ctx context.Context) (*shutdownReport, error) {
+	if forceShutdown {
+		// When shutting down, it is not an error if the executable was not found.
+		if executablePath := findExecutable(ctx, true); executablePath != "" {
+			return terminateProcess(ctx, executablePath)
+		}
+		return &shutdownReport{}, nil
+	}
+	return terminateOwnedProcess(ctx)
+}
+
+func (ollamaBackend) health(ctx context.Context) (bool, error) {
+	return checkExistingInstance(ctx)
+}
+
+func (ollamaBackend) models(ctx context.Context) ([]string, error) {
+	var tags struct {
+		Models []struct {
+			Name string `json:"name"`
+		} `json:"models"`
+	}
+	if err := getServerJSON(ctx, "/api/tags", &tags); err != nil {
+		return nil, err
+	}
+	models := []string{}
+	for _, model := range tags.Models {
+		models = append(models, model.Name)
+	}
+	return models, nil
+}
+
+func (ollamaBackend) version(ctx context.Context) (string, error) {
+	var version struct {
+		Version string `json:"version"`
+	}
+	if err := getServerJSON(ctx, "/api/version", &version); err != nil {
+		return "", err
+	}
+	return version.Version, nil
+}
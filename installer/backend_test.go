@@ -0,0 +1,225 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+// fakeBackend is a backend whose responses are set by the test, recording the
+// methods called.
+type fakeBackend struct {
+	exe        string
+	running    bool
+	healthErr  error
+	serverVer  string
+	versionErr error
+	served     []string
+	stopped    *shutdownReport
+	calls      []string
+}
+
+func (b *fakeBackend) name() string {
+	return "fake"
+}
+
+func (b *fakeBackend) executable(ctx context.Context) string {
+	b.calls = append(b.calls, "executable")
+	return b.exe
+}
+
+func (b *fakeBackend) install(ctx context.Context) error {
+	b.calls = append(b.calls, "install")
+	return nil
+}
+
+func (b *fakeBackend) start(ctx context.Context) error {
+	b.calls = append(b.calls, "start")
+	b.running = true
+	return nil
+}
+
+func (b *fakeBackend) stop(ctx context.Context) (*shutdownReport, error) {
+	b.calls = append(b.calls, "stop")
+	b.running = false
+	return b.stopped, nil
+}
+
+func (b *fakeBackend) health(ctx context.Context) (bool, error) {
+	b.calls = append(b.calls, "health")
+	return b.running, b.healthErr
+}
+
+func (b *fakeBackend) models(ctx context.Context) ([]string, error) {
+	b.calls = append(b.calls, "models")
+	return b.served, nil
+}
+
+func (b *fakeBackend) version(ctx context.Context) (string, error) {
+	b.calls = append(b.calls, "version")
+	return b.serverVer, b.versionErr
+}
+
+// Use a configuration with all paths in a temporary directory for the test.
+func useTestConfig(t *testing.T, backend string) {
+	saved := config
+	t.Cleanup(func() { config = saved })
+	dir := t.TempDir()
+	config = defaultConfig()
+	config.Backend = backend
+	config.Paths.Install = filepath.Join(dir, "install")
+	config.Paths.State = filepath.Join(dir, "state")
+	config.Paths.Logs = filepath.Join(dir, "logs")
+	config.Paths.Models = filepath.Join(dir, "models")
+	config.Paths.Cache = filepath.Join(dir, "cache")
+}
+
+func TestGetServerURL(t *testing.T) {
+	tests := []struct {
+		backend   string
+		remoteURL string
+		want      string
+	}{
+		{backendOllama, "", "http://localhost:11434"},
+		{backendLlamaCpp, "", "http://localhost:11435"},
+		{backendRemote, "https://gpu.example.com:8443/ollama/", "https://gpu.example.com:8443/ollama"},
+	}
+	for _, test := range tests {
+		useTestConfig(t, test.backend)
+		config.Remote.URL = test.remoteURL
+		if got := getServerURL(); got != test.want {
+			t.Errorf("server URL for %s = %q, want %q", test.backend, got, test.want)
+		}
+	}
+}
+
+func TestIsBackendInstalled(t *testing.T) {
+	tests := []struct {
+		name    string
+		backend fakeBackend
+		want    bool
+	}{
+		{name: "not installed", want: false},
+		{name: "installed", backend: fakeBackend{exe: "/opt/fake/server"}, want: true},
+		{name: "running elsewhere", backend: fakeBackend{running: true}, want: true},
+		{name: "health check failed", backend: fakeBackend{running: true, healthErr: errors.New("failed")}, want: false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := isBackendInstalled(context.Background(), &test.backend); got != test.want {
+				t.Errorf("got %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestGetLocalStatus(t *testing.T) {
+	tests := []struct {
+		name        string
+		backend     fakeBackend
+		wantVersion string
+		wantModels  []string
+		wantCalls   []string
+	}{
+		{
+			name:      "not installed",
+			wantCalls: []string{"executable", "health"},
+		},
+		{
+			name:        "installed",
+			backend:     fakeBackend{exe: "/opt/fake/server", serverVer: "1.0"},
+			wantVersion: "1.0",
+			wantCalls:   []string{"executable", "health", "version"},
+		},
+		{
+			name:        "running",
+			backend:     fakeBackend{exe: "/opt/fake/server", running: true, serverVer: "1.0", served: []string{"tinyllama"}},
+			wantVersion: "1.0",
+			wantModels:  []string{"tinyllama"},
+			wantCalls:   []string{"executable", "health", "version", "models"},
+		},
+		{
+			name:       "version unknown",
+			backend:    fakeBackend{running: true, versionErr: errors.New("failed"), served: []string{}},
+			wantModels: []string{},
+			wantCalls:  []string{"executable", "health", "version", "models"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			useTestConfig(t, backendLlamaCpp)
+			var status installStatus
+			if err := getLocalStatus(context.Background(), &test.backend, &status); err != nil {
+				t.Fatalf("failed to get status: %s", err)
+			}
+			if status.Installed != (test.backend.exe != "") || status.Running != test.backend.running {
+				t.Errorf("got installed %v, running %v", status.Installed, status.Running)
+			}
+			if status.Version != test.wantVersion {
+				t.Errorf("got version %q, want %q", status.Version, test.wantVersion)
+			}
+			if !slices.Equal(status.ServerModels, test.wantModels) {
+				t.Errorf("got server models %v, want %v", status.ServerModels, test.wantModels)
+			}
+			if status.Models.Path != config.Paths.Models || status.Managed {
+				t.Errorf("got models path %q, managed %v", status.Models.Path, status.Managed)
+			}
+			if !slices.Equal(test.backend.calls, test.wantCalls) {
+				t.Errorf("got calls %v, want %v", test.backend.calls, test.wantCalls)
+			}
+		})
+	}
+
+	useTestConfig(t, backendLlamaCpp)
+	b := fakeBackend{healthErr: errors.New("failed")}
+	if err := getLocalStatus(context.Background(), &b, &installStatus{}); err == nil {
+		t.Errorf("expected an error when the health check fails")
+	}
+}
+
+func TestShutdownServer(t *testing.T) {
+	useTestConfig(t, backendLlamaCpp)
+	ctx := context.Background()
+	if err := writePIDFile(ctx, os.Getpid(), "/opt/fake/server", nil); err != nil {
+		t.Fatal(err)
+	}
+	b := fakeBackend{
+		running: true,
+		stopped: &shutdownReport{Processes: []stoppedProcess{{PID: 1234, Executable: "/opt/fake/server", Method: stopMethodTerminated}}},
+	}
+
+	output, err := os.Create(filepath.Join(t.TempDir(), "stdout"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer output.Close()
+	stdout := os.Stdout
+	os.Stdout = output
+	err = shutdownServer(ctx, &b)
+	os.Stdout = stdout
+	if err != nil {
+		t.Fatalf("failed to shut down: %s", err)
+	}
+
+	if b.running || !slices.Equal(b.calls, []string{"stop"}) {
+		t.Errorf("server was not stopped: calls %v", b.calls)
+	}
+	if pidFile, err := readPIDFile(ctx); err != nil || pidFile != nil {
+		t.Errorf("PID file was not removed: %+v, %v", pidFile, err)
+	}
+	buf, err := os.ReadFile(output.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var report shutdownReport
+	if err = json.Unmarshal(buf, &report); err != nil {
+		t.Fatalf("invalid report %q: %s", buf, err)
+	}
+	if len(report.Processes) != 1 || report.Processes[0].PID != 1234 {
+		t.Errorf("got report %+v", report)
+	}
+}
@@ -0,0 +1,19 @@
+//go:build !windows
+
+package main
+
+import (
+	"context"
+
+	"golang.org/x/sys/unix"
+)
+
+// Arrange for cancel to be called when another installer process asks us to
+// stop.  On Unix, that is done with SIGTERM, which main already handles.
+func watchCancelRequests(ctx context.Context, cancel context.CancelFunc) {
+}
+
+// Ask the installer process with the given PID to cancel its operation.
+func requestCancel(pid int) error {
+	return unix.Kill(pid, unix.SIGTERM)
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+
+	"golang.org/x/sys/windows"
+)
+
+// Get the name of the event used to ask the installer process with the given
+// PID to cancel its operation.
+func cancelEventName(pid int) string {
+	return fmt.Sprintf(`Local\rd-open-webui-installer-cancel-%d`, pid)
+}
+
+// Arrange for cancel to be called when another installer process asks us to
+// stop.  Windows has no signals we can send to a process without a console, so
+// this uses a named event instead.
+func watchCancelRequests(ctx context.Context, cancel context.CancelFunc) {
+	name, err := windows.UTF16PtrFromString(cancelEventName(os.Getpid()))
+	if err != nil {
+		log.Printf("Failed to create cancel event: %s", err)
+		return
+	}
+	event, err := windows.CreateEvent(nil, 1, 0, name)
+	if err != nil {
+		log.Printf("Failed to create cancel event: %s", err)
+		return
+	}
+	go func() {
+		defer windows.CloseHandle(event)
+		if _, err := windows.WaitForSingleObject(event, windows.INFINITE); err == nil {
+			cancel()
+		}
+	}()
+}
+
+// Ask the installer process with the given PID to cancel its operation.
+func requestCancel(pid int) error {
+	name, err := windows.UTF16PtrFromString(cancelEventName(pid))
+	if err != nil {
+		return err
+	}
+	event, err := windows.OpenEvent(windows.EVENT_MODIFY_STATE, false, name)
+	if err != nil {
+		return err
+	}
+	defer windows.CloseHandle(event)
+	return windows.SetEvent(event)
+}
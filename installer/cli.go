@@ -0,0 +1,186 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+	"text/tabwriter"
+)
+
+// command is an installer subcommand, run as "installer <name> [flags]".
+type command struct {
+	name        string // Words separated by spaces, e.g. "models pull".
+	mode        Mode
+	description string
+	flags       []func(*flag.FlagSet) // Registers the flags the command accepts.
+}
+
+// The installer subcommands, in the order they are listed in the usage.
+var commands = []command{
+	{"install", ModeInstall, "Download and install the configured backend (ollama by default)", []func(*flag.FlagSet){configFlags("release", "connections", "rate-limit", "rate-schedule"), preflightFlags}},
+	{"uninstall", ModeUninstall, "Uninstall the managed ollama, optionally deleting models, caches, logs and config", []func(*flag.FlagSet){uninstallFlags, stopFlags}},
+	{"check", ModeCheck, `Check if the backend is installed, printing "true" or "false"`, nil},
+	{"start", ModeStart, "Start the backend server; for ollama, also pull the configured models in the background", []func(*flag.FlagSet){configFlags("model")}},
+	{"shutdown", ModeShutdown, "Stop the backend server", []func(*flag.FlagSet){shutdownFlags, stopFlags}},
+	{"cancel", ModeCancel, "Cancel an in-progress install, start or model pull", []func(*flag.FlagSet){lockFlags}},
+	{"verify", ModeVerify, "Check the installed files against the install receipt, printing the result as JSON", nil},
+	{"repair", ModeRepair, "Download the installed release again and restore any damaged files", []func(*flag.FlagSet){stopFlags, configFlags("connections", "rate-limit", "rate-schedule")}},
+	{"releases", ModeReleases, "List the ollama releases available for this machine as JSON, marking the one install would use", []func(*flag.FlagSet){configFlags("release")}},
+	{"update-check", ModeUpdateCheck, "Check if a newer ollama release than the installed one is available, printing the result as JSON", []func(*flag.FlagSet){updateCheckFlags, configFlags("release")}},
+	{"status", ModeStatus, "Print the install and server status as JSON", nil},
+	{"preflight", ModePreflight, "Check whether ollama can be installed, printing findings as JSON", []func(*flag.FlagSet){configFlags("release")}},
+	{"diagnose", ModeDiagnose, "Collect diagnostic information into a tar.gz file", []func(*flag.FlagSet){diagnoseFlags, configFlags("release")}},
+	{"config show", ModeConfig, "Print the effective configuration and where each value came from", nil},
+	{"config apply", ModeApply, "Restart the ollama server if its settings have changed", []func(*flag.FlagSet){stopFlags}},
+	{"models pull", ModePull, "Pull models, recording progress for \"models pull-status\"", []func(*flag.FlagSet){configFlags("model")}},
+	{"models pull-status", ModePullStatus, "Print the status of the background model pull as JSON", nil},
+	{"models detect", ModeModelsDetect, "List models directories of external ollama installs as JSON", nil},
+	{"models import", ModeModelsImport, "Import models from an external ollama install", []func(*flag.FlagSet){modelsSourceFlags}},
+	{"models share", ModeModelsShare, "Use the models directory of an external ollama install", []func(*flag.FlagSet){modelsSourceFlags}},
+	{"proxy", ModeProxy, "Serve the remote ollama server on the ollama port for Open WebUI; run by start with the remote backend", nil},
+}
+
+// The flags accepted with the legacy -mode flag, which accepts every flag
+// regardless of mode.
+var allFlags = []func(*flag.FlagSet){
+	lockFlags, stopFlags, shutdownFlags, uninstallFlags, modelsSourceFlags,
+	preflightFlags, diagnoseFlags, updateCheckFlags, configFlags(),
+}
+
+// Get a function registering the given config setting flags; with no names,
+// all of them are registered.
+func configFlags(names ...string) func(*flag.FlagSet) {
+	return func(flags *flag.FlagSet) {
+		registerConfigFlags(flags, names...)
+	}
+}
+
+// Create the flag set for the command.
+func (c *command) flagSet() *flag.FlagSet {
+	flags := flag.NewFlagSet("installer "+c.name, flag.ExitOnError)
+	for _, register := range c.flags {
+		register(flags)
+	}
+	if slices.Contains(mutatingModes, c.mode) && flags.Lookup("lock-timeout") == nil {
+		lockFlags(flags)
+	}
+	flags.Usage = func() {
+		out := flags.Output()
+		fmt.Fprintf(out, "Usage: installer %s [flags]\n\n%s.\n", c.name, c.description)
+		hasFlags := false
+		flags.VisitAll(func(*flag.Flag) { hasFlags = true })
+		if hasFlags {
+			fmt.Fprintf(out, "\nFlags:\n")
+			flags.PrintDefaults()
+		}
+	}
+	return flags
+}
+
+// Find the command named by the leading arguments, preferring the longest
+// match; returns the remaining arguments.
+func findCommand(args []string) (*command, []string) {
+	var found *command
+	var length int
+	for i, c := range commands {
+		words := strings.Fields(c.name)
+		if len(words) > length && len(words) <= len(args) && slices.Equal(words, args[:len(words)]) {
+			found, length = &commands[i], len(words)
+		}
+	}
+	return found, args[length:]
+}
+
+// Print the list of commands whose names start with the prefix.
+func printCommands(out io.Writer, prefix string) {
+	writer := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+	for _, c := range commands {
+		if strings.HasPrefix(c.name, prefix) {
+			fmt.Fprintf(writer, "  %s\t%s\n", c.name, c.description)
+		}
+	}
+	writer.Flush()
+}
+
+func printUsage(out io.Writer) {
+	fmt.Fprintf(out, "Usage: installer <command> [flags]\n\nCommands:\n")
+	printCommands(out, "")
+	fmt.Fprintf(out, "\nRun \"installer help <command>\" for the flags of a command.\n")
+	fmt.Fprintf(out, "The form \"installer -mode=<mode> [flags]\" is also accepted for compatibility.\n")
+}
+
+// Parse the command line, setting the mode; returns the flags for the command.
+// Invalid command lines exit the process.
+func parseCommandLine(args []string) *flag.FlagSet {
+	if len(args) == 0 || strings.HasPrefix(args[0], "-") {
+		return parseLegacyCommandLine(args)
+	}
+
+	if args[0] == "help" {
+		if len(args) == 1 {
+			printUsage(os.Stdout)
+			os.Exit(0)
+		}
+		if c, rest := findCommand(args[1:]); c != nil && len(rest) == 0 {
+			flags := c.flagSet()
+			flags.SetOutput(os.Stdout)
+			flags.Usage()
+			os.Exit(0)
+		}
+		args = args[1:]
+	}
+
+	c, rest := findCommand(args)
+	if c == nil {
+		// This may be the name of a group of commands, such as "models".
+		prefix := strings.Join(args[:1], " ") + " "
+		fmt.Fprintf(os.Stderr, "Unknown command %q.\n\n", strings.Join(args, " "))
+		for _, c := range commands {
+			if strings.HasPrefix(c.name, prefix) {
+				fmt.Fprintf(os.Stderr, "Commands:\n")
+				printCommands(os.Stderr, prefix)
+				os.Exit(2)
+			}
+		}
+		printUsage(os.Stderr)
+		os.Exit(2)
+	}
+	flags := c.flagSet()
+	_ = flags.Parse(rest) // Exits on error.
+	if flags.NArg() > 0 {
+		fmt.Fprintf(os.Stderr, "Unexpected argument %q.\n\n", flags.Arg(0))
+		flags.Usage()
+		os.Exit(2)
+	}
+	mode = c.mode
+	return flags
+}
+
+// Parse a command line using -mode to select the operation.
+func parseLegacyCommandLine(args []string) *flag.FlagSet {
+	var modes []string
+	for _, c := range commands {
+		modes = append(modes, string(c.mode))
+	}
+	flags := flag.CommandLine
+	flags.Func("mode", fmt.Sprintf("operation mode; one of %s (default %q)", strings.Join(modes, ", "), mode), func(s string) error {
+		if !slices.Contains(modes, s) {
+			return fmt.Errorf("unexpected mode %s: should be one of %s", s, strings.Join(modes, ", "))
+		}
+		mode = Mode(s)
+		return nil
+	})
+	for _, register := range allFlags {
+		register(flags)
+	}
+	flags.Usage = func() {
+		printUsage(flags.Output())
+		fmt.Fprintf(flags.Output(), "\nFlags with -mode:\n")
+		flags.PrintDefaults()
+	}
+	_ = flags.Parse(args) // Exits on error.
+	return flags
+}
@@ -0,0 +1,424 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+const (
+	configFileName  = "installer.json"
+	configDirName   = "rd-open-webui"
+	configEnvPrefix = "RD_OPEN_WEBUI_"
+)
+
+// installerConfig is the effective installer configuration.  It is assembled
+// from (in increasing order of precedence) built-in defaults, the config file
+// in the extension directory, the per-user config file, environment variables,
+// and command line flags.
+type installerConfig struct {
+	Backend  string            `json:"backend"` // See knownBackends.
+	Remote   remoteConfig      `json:"remote"`
+	LlamaCpp llamaCppConfig    `json:"llamaCpp"`
+	Release  string            `json:"release"`
+	Models   []string          `json:"models"`
+	Server   map[string]string `json:"server"` // Environment for the ollama server.
+	Proxy    string            `json:"proxy"`
+	Paths    pathsConfig       `json:"paths"`
+	Ports    portsConfig       `json:"ports"`
+	Download downloadConfig    `json:"download"`
+
+	// sources records where each setting came from, keyed by setting name.
+	sources map[string]string
+}
+
+type pathsConfig struct {
+	Install string `json:"install"`
+	State   string `json:"state"`
+	Logs    string `json:"logs"`
+	Models  string `json:"models"` // Where the managed server stores models.
+	Cache   string `json:"cache"`
+	// SharedModels is the models directory of an external install that models
+	// share pointed the managed server at; it is never deleted.
+	SharedModels string `json:"sharedModels"`
+}
+
+// portsConfig holds the ports that can be configured; see defaultOllamaPort.
+type portsConfig struct {
+	Ollama int `json:"ollama"` // Where the managed server (or remote proxy) listens.
+}
+
+type downloadConfig struct {
+	Connections int      `json:"connections"` // For downloading release assets.
+	RateLimit   string   `json:"rateLimit"`   // Bytes per second, e.g. "2M"; empty for no limit.
+	Schedule    []string `json:"schedule"`    // Rate limits by time of day, e.g. "09:00-18:00=1M".
+}
+
+// config is the effective configuration, loaded by main.
+var config = defaultConfig()
+
+// configSetting describes a single setting that may be set from a file, an
+// environment variable, or a flag.
+type configSetting struct {
+	name  string // Dotted path in the config file, e.g. "remote.url".
+	flag  string // Command line flag that overrides this setting, if any.
+	usage string // Help text for the flag.
+	// fromString sets the value from an environment variable or flag.
+	fromString func(c *installerConfig, value string) error
+	// fromJSON sets the value from a config file.
+	fromJSON func(c *installerConfig, value json.RawMessage) error
+	// value returns the current value, for display.
+	value func(c *installerConfig) any
+}
+
+// Get the environment variable that overrides this setting.
+func (s *configSetting) env() string {
+	return configEnvPrefix + strings.ToUpper(strings.ReplaceAll(s.name, ".", "_"))
+}
+
+func stringSetting(name, flagName, usage string, field func(*installerConfig) *string) configSetting {
+	return configSetting{
+		name:  name,
+		flag:  flagName,
+		usage: usage,
+		fromString: func(c *installerConfig, value string) error {
+			*field(c) = value
+			return nil
+		},
+		fromJSON: func(c *installerConfig, value json.RawMessage) error {
+			return json.Unmarshal(value, field(c))
+		},
+		value: func(c *installerConfig) any { return *field(c) },
+	}
+}
+
+// An integer setting that must be within the given range.
+func intSetting(name, flagName, usage string, minValue, maxValue int, field func(*installerConfig) *int) configSetting {
+	validate := func(value int) error {
+		if value < minValue || value > maxValue {
+			return fmt.Errorf("%d is out of range (%d to %d)", value, minValue, maxValue)
+		}
+		return nil
+	}
+	return configSetting{
+		name:  name,
+		flag:  flagName,
+		usage: usage,
+		fromString: func(c *installerConfig, value string) error {
+			number, err := strconv.Atoi(value)
+			if err != nil {
+				return fmt.Errorf("invalid number %q", value)
+			}
+			*field(c) = number
+			return validate(number)
+		},
+		fromJSON: func(c *installerConfig, value json.RawMessage) error {
+			if err := json.Unmarshal(value, field(c)); err != nil {
+				return err
+			}
+			return validate(*field(c))
+		},
+		value: func(c *installerConfig) any { return *field(c) },
+	}
+}
+
+// A list setting is comma separated when given as a string.
+func listSetting(name, flagName, usage string, field func(*installerConfig) *[]string) configSetting {
+	return configSetting{
+		name:  name,
+		flag:  flagName,
+		usage: usage,
+		fromString: func(c *installerConfig, value string) error {
+			var list []string
+			for _, item := range strings.Split(value, ",") {
+				if item = strings.TrimSpace(item); item != "" {
+					list = append(list, item)
+				}
+			}
+			*field(c) = list
+			return nil
+		},
+		fromJSON: func(c *installerConfig, value json.RawMessage) error {
+			*field(c) = nil
+			return json.Unmarshal(value, field(c))
+		},
+		value: func(c *installerConfig) any { return *field(c) },
+	}
+}
+
+// configSettings lists all known settings.  The server environment is handled
+// separately, as it is a map where each entry has its own source.
+var configSettings = []configSetting{
+	stringSetting("backend", "", "", func(c *installerConfig) *string { return &c.Backend }),
+	stringSetting("remote.url", "", "", func(c *installerConfig) *string { return &c.Remote.URL }),
+	stringSetting("remote.token", "", "", func(c *installerConfig) *string { return &c.Remote.Token }),
+	stringSetting("llamaCpp.release", "", "", func(c *installerConfig) *string { return &c.LlamaCpp.Release }),
+	stringSetting("llamaCpp.model", "", "", func(c *installerConfig) *string { return &c.LlamaCpp.Model }),
+	stringSetting("release", "release", `release to download when installing: a tag, "latest", "stable", "prerelease", or a version constraint such as "~0.5" or ">=0.5.4 <0.6"`, func(c *installerConfig) *string { return &c.Release }),
+	listSetting("models", "model", "comma-separated models to pull on start; set to empty string to skip", func(c *installerConfig) *[]string { return &c.Models }),
+	stringSetting("proxy", "", "", func(c *installerConfig) *string { return &c.Proxy }),
+	stringSetting("paths.install", "", "", func(c *installerConfig) *string { return &c.Paths.Install }),
+	stringSetting("paths.state", "", "", func(c *installerConfig) *string { return &c.Paths.State }),
+	stringSetting("paths.logs", "", "", func(c *installerConfig) *string { return &c.Paths.Logs }),
+	stringSetting("paths.models", "", "", func(c *installerConfig) *string { return &c.Paths.Models }),
+	stringSetting("paths.cache", "", "", func(c *installerConfig) *string { return &c.Paths.Cache }),
+	stringSetting("paths.sharedModels", "", "", func(c *installerConfig) *string { return &c.Paths.SharedModels }),
+	intSetting("ports.ollama", "", "", 1, 65535, func(c *installerConfig) *int { return &c.Ports.Ollama }),
+	intSetting("download.connections", "connections", "number of connections to download release assets over", 1, maxDownloadConnections, func(c *installerConfig) *int { return &c.Download.Connections }),
+	stringSetting("download.rateLimit", "rate-limit", `limit for downloading release assets, in bytes per second, e.g. "500K" or "2M"; 0 for no limit`, func(c *installerConfig) *string { return &c.Download.RateLimit }),
+	listSetting("download.schedule", "rate-schedule", `comma-separated rate limits by local time of day, e.g. "09:00-18:00=1M"`, func(c *installerConfig) *[]string { return &c.Download.Schedule }),
+}
+
+const serverSettingPrefix = "server."
+
+// Return the built-in default configuration.  The install path defaults to a
+// location within the extension directory, and the others to per-user
+// directories that survive extension upgrades; paths are left empty if they
+// cannot be determined.
+func defaultConfig() installerConfig {
+	c := installerConfig{
+		Backend:  backendOllama,
+		LlamaCpp: llamaCppConfig{Release: releaseLatest},
+		Release:  "latest",
+		Models:   []string{"tinyllama"},
+		Server:   map[string]string{},
+		Ports:    portsConfig{Ollama: defaultOllamaPort},
+		Download: downloadConfig{Connections: 4},
+		sources:  map[string]string{},
+	}
+	if extensionDir, err := getExtensionDir(); err == nil {
+		c.Paths.Install = filepath.Join(extensionDir, "ollama")
+	}
+	c.Paths.State, _ = getDefaultDataLocation("state")
+	c.Paths.Logs, _ = getDefaultDataLocation("logs")
+	c.Paths.Models, _ = getDefaultDataLocation("models")
+	c.Paths.Cache, _ = getDefaultCacheLocation()
+	for _, setting := range configSettings {
+		c.sources[setting.name] = "default"
+	}
+	return c
+}
+
+// Get the locations of the config files, in increasing order of precedence:
+// the extension default, then the per-user file.
+func getConfigFiles() []string {
+	var result []string
+	if extensionDir, err := getExtensionDir(); err == nil {
+		result = append(result, filepath.Join(extensionDir, configFileName))
+	}
+	if userConfigPath, err := getUserConfigFile(); err == nil {
+		result = append(result, userConfigPath)
+	}
+	return result
+}
+
+// Get the location of the per-user config file.
+func getUserConfigFile() (string, error) {
+	configDir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(configDir, configDirName, configFileName), nil
+}
+
+// Register command line flags for the settings that have them; if names are
+// given, only those flags are registered.  The flags are only used to detect
+// which settings were overridden; see loadConfig.
+func registerConfigFlags(flags *flag.FlagSet, names ...string) {
+	defaults := defaultConfig()
+	for _, setting := range configSettings {
+		if setting.flag == "" || (len(names) > 0 && !slices.Contains(names, setting.flag)) {
+			continue
+		}
+		value := setting.value(&defaults)
+		if list, ok := value.([]string); ok {
+			value = strings.Join(list, ",")
+		}
+		flags.String(setting.flag, fmt.Sprint(value), setting.usage+"; overrides the config file")
+	}
+}
+
+// Load the effective configuration.  Flags must have been parsed.
+func loadConfig(ctx context.Context, flags *flag.FlagSet) (installerConfig, error) {
+	return loadConfigFiles(flags, getConfigFiles())
+}
+
+// Load the effective configuration from the given config files, in increasing
+// order of precedence, followed by environment variables and flags.
+func loadConfigFiles(flags *flag.FlagSet, paths []string) (installerConfig, error) {
+	c := defaultConfig()
+
+	for _, path := range paths {
+		if err := c.mergeFile(path); err != nil {
+			return c, err
+		}
+	}
+
+	for _, setting := range configSettings {
+		env := setting.env()
+		if value, ok := os.LookupEnv(env); ok {
+			if err := setting.fromString(&c, value); err != nil {
+				return c, fmt.Errorf("invalid %s: %w", env, err)
+			}
+			c.sources[setting.name] = "env " + env
+		}
+	}
+
+	for _, name := range knownServerSettings() {
+		env := configEnvPrefix + "SERVER_" + name
+		if value, ok := os.LookupEnv(env); ok {
+			c.Server[name] = value
+			c.sources[serverSettingPrefix+name] = "env " + env
+		}
+	}
+
+	var err error
+	flags.Visit(func(f *flag.Flag) {
+		for _, setting := range configSettings {
+			if setting.flag == f.Name && err == nil {
+				if err = setting.fromString(&c, f.Value.String()); err != nil {
+					err = fmt.Errorf("invalid -%s: %w", f.Name, err)
+				}
+				c.sources[setting.name] = "flag -" + f.Name
+			}
+		}
+	})
+	if err != nil {
+		return c, err
+	}
+
+	if err = validateBackend(&c); err != nil {
+		return c, err
+	}
+	if err = validateServerSettings(c.Server); err != nil {
+		return c, err
+	}
+	if _, err = parseDownloadRate(c.Download); err != nil {
+		return c, err
+	}
+
+	return c, nil
+}
+
+// Merge settings from the given config file; it is not an error if the file
+// does not exist.
+func (c *installerConfig) mergeFile(path string) error {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return fmt.Errorf("failed to read config file: %w", err)
+	}
+	var values map[string]json.RawMessage
+	if err = json.Unmarshal(buf, &values); err != nil {
+		return fmt.Errorf("failed to parse config file %s: %w", path, err)
+	}
+	flattened := make(map[string]json.RawMessage)
+	for key, value := range values {
+		if key == "server" {
+			var server map[string]string
+			if err = json.Unmarshal(value, &server); err != nil {
+				return fmt.Errorf("invalid setting server in %s: %w", path, err)
+			}
+			for name, value := range server {
+				c.Server[name] = value
+				c.sources[serverSettingPrefix+name] = "file " + path
+			}
+			continue
+		}
+		// Nested objects are flattened into dotted setting names.
+		var nested map[string]json.RawMessage
+		if bytes.HasPrefix(bytes.TrimSpace(value), []byte("{")) && json.Unmarshal(value, &nested) == nil {
+			for subkey, subvalue := range nested {
+				flattened[key+"."+subkey] = subvalue
+			}
+		} else {
+			flattened[key] = value
+		}
+	}
+	for name, value := range flattened {
+		index := -1
+		for i := range configSettings {
+			if configSettings[i].name == name {
+				index = i
+			}
+		}
+		if index < 0 && strings.HasPrefix(name, "ports.") {
+			return fmt.Errorf("unsupported setting %s in %s: only ports.ollama can be changed; the other ports are fixed by docker-compose.yaml", name, path)
+		} else if index < 0 {
+			return fmt.Errorf("unknown setting %s in %s", name, path)
+		}
+		if err = configSettings[index].fromJSON(c, value); err != nil {
+			return fmt.Errorf("invalid setting %s in %s: %w", name, path, err)
+		}
+		c.sources[name] = "file " + path
+	}
+	return nil
+}
+
+// Modify the per-user config file, creating it if needed.  Unknown settings in
+// the file are preserved.
+func updateUserConfig(update func(values map[string]any)) error {
+	path, err := getUserConfigFile()
+	if err != nil {
+		return fmt.Errorf("failed to find user config file: %w", err)
+	}
+	values := make(map[string]any)
+	if buf, err := os.ReadFile(path); err == nil {
+		if err = json.Unmarshal(buf, &values); err != nil {
+			return fmt.Errorf("failed to parse config file %s: %w", path, err)
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to read config file: %w", err)
+	}
+	update(values)
+	buf, err := json.MarshalIndent(values, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to serialize config: %w", err)
+	}
+	if err = os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return fmt.Errorf("failed to create config directory: %w", err)
+	}
+	if err = os.WriteFile(path, append(buf, '\n'), 0o644); err != nil {
+		return fmt.Errorf("failed to write config file: %w", err)
+	}
+	return nil
+}
+
+// configEntry is a setting, as printed by ModeConfig.
+type configEntry struct {
+	Value  any    `json:"value"`
+	Source string `json:"source"`
+}
+
+// Describe each setting in the configuration along with its source.
+func (c *installerConfig) describe() map[string]configEntry {
+	result := make(map[string]configEntry)
+	for _, setting := range configSettings {
+		result[setting.name] = configEntry{Value: setting.value(c), Source: c.sources[setting.name]}
+	}
+	for name, value := range c.Server {
+		result[serverSettingPrefix+name] = configEntry{Value: value, Source: c.sources[serverSettingPrefix+name]}
+	}
+	return result
+}
+
+// Print the effective configuration, with the source of each value, as JSON.
+// Secrets are redacted, as for diagnostics bundles.
+func printConfig(ctx context.Context) error {
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(redactedConfig()); err != nil {
+		return fmt.Errorf("failed to output configuration: %w", err)
+	}
+	return nil
+}
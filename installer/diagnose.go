@@ -0,0 +1,381 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"runtime/debug"
+	"strings"
+	"time"
+)
+
+var diagnoseOutput string
+
+// Register the flags used when collecting diagnostics.
+func diagnoseFlags(flags *flag.FlagSet) {
+	flags.StringVar(&diagnoseOutput, "output", "", "directory to write the diagnostics bundle to; defaults to the log directory")
+}
+
+const (
+	// How much of the end of each log file to include in the bundle.
+	diagnoseLogTail = 1024 * 1024
+	// How much of each health check response to include in the bundle.
+	diagnoseMaxBody = 4096
+	// How long to wait for each health check.
+	diagnoseHealthTimeout = 5 * time.Second
+)
+
+// Settings whose names contain any of these are never written to the bundle.
+var secretSettingNames = []string{"token", "password", "secret", "key"}
+
+// installerVersion describes the build of the installer.
+type installerVersion struct {
+	Version   string `json:"version"`
+	Revision  string `json:"revision,omitempty"`
+	GoVersion string `json:"goVersion"`
+}
+
+// hardwareInfo describes the machine the installer is running on.
+type hardwareInfo struct {
+	OS     string `json:"os"`
+	Arch   string `json:"arch"`
+	CPUs   int    `json:"cpus"`
+	Memory uint64 `json:"memory,omitempty"` // Total physical memory, in bytes.
+	Error  string `json:"error,omitempty"`
+}
+
+// portOwner describes which process, if any, is listening on a port.
+type portOwner struct {
+	Name       string `json:"name"`
+	Port       int    `json:"port"`
+	InUse      bool   `json:"inUse"`
+	PID        int    `json:"pid,omitempty"`
+	Executable string `json:"executable,omitempty"`
+	Error      string `json:"error,omitempty"`
+}
+
+// healthResponse is the result of a request to a service's health endpoint.
+type healthResponse struct {
+	Name   string `json:"name"`
+	URL    string `json:"url"`
+	Status int    `json:"status,omitempty"`
+	Body   string `json:"body,omitempty"` // Truncated to diagnoseMaxBody.
+	Error  string `json:"error,omitempty"`
+	// serverPath is set for endpoints of the backend server, which may need
+	// credentials; see newServerRequest.
+	serverPath string
+}
+
+// Get the version information embedded in the installer at build time.
+func getInstallerVersion() installerVersion {
+	result := installerVersion{Version: "unknown", GoVersion: runtime.Version()}
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return result
+	}
+	result.Version = info.Main.Version
+	for _, setting := range info.Settings {
+		if setting.Key == "vcs.revision" {
+			result.Revision = setting.Value
+		}
+	}
+	return result
+}
+
+// Describe the effective configuration, with secrets removed.  Any URLs have
+// their passwords removed, as they may contain proxy credentials.
+func redactedConfig() map[string]configEntry {
+	entries := config.describe()
+	for name, entry := range entries {
+		lowerName := strings.ToLower(name)
+		for _, secret := range secretSettingNames {
+			if strings.Contains(lowerName, secret) && entry.Value != "" {
+				entry.Value = "[redacted]"
+			}
+		}
+		if value, ok := entry.Value.(string); ok && strings.Contains(value, "@") {
+			if u, err := url.Parse(value); err == nil && u.User != nil {
+				entry.Value = u.Redacted()
+			}
+		}
+		entries[name] = entry
+	}
+	return entries
+}
+
+func getHardwareInfo() hardwareInfo {
+	info := hardwareInfo{OS: runtime.GOOS, Arch: runtime.GOARCH, CPUs: runtime.NumCPU()}
+	memory, err := getTotalMemory()
+	if err != nil {
+		info.Error = fmt.Sprintf("failed to get memory size: %s", err)
+	}
+	info.Memory = memory
+	return info
+}
+
+// List the running processes that look like ollama (including its runners).
+func findOllamaProcesses() ([]stoppedProcess, error) {
+	procs, err := listProcesses()
+	if err != nil {
+		return nil, fmt.Errorf("error listing processes: %w", err)
+	}
+	result := []stoppedProcess{}
+	for _, proc := range procs {
+		if strings.Contains(strings.ToLower(filepath.Base(proc.Executable)), "ollama") {
+			result = append(result, stoppedProcess{PID: proc.PID, PPID: proc.PPID, Executable: proc.Executable})
+		}
+	}
+	return result, nil
+}
+
+// Find which processes are listening on the ports we use.
+func getPortOwners(ctx context.Context) []portOwner {
+	owners := []portOwner{
+		{Name: "ollama", Port: config.Ports.Ollama},
+		{Name: "llama-server", Port: llamaServerPort},
+		{Name: "open-webui", Port: openWebUIPort},
+		{Name: "searxng", Port: searxngPort},
+	}
+	procs, _ := listProcesses()
+	for i := range owners {
+		pid, err := findPortOwner(ctx, owners[i].Port)
+		if err != nil {
+			owners[i].Error = err.Error()
+			continue
+		}
+		if pid == 0 {
+			continue
+		}
+		owners[i].InUse, owners[i].PID = true, pid
+		for _, proc := range procs {
+			if proc.PID == pid {
+				owners[i].Executable = proc.Executable
+			}
+		}
+	}
+	return owners
+}
+
+// Query the health endpoints of the backend server and the extension
+// containers.
+func getHealthResponses(ctx context.Context) []healthResponse {
+	responses := []healthResponse{
+		{Name: "ollama-version", serverPath: "/api/version"},
+		{Name: "ollama-models", serverPath: "/api/tags"},
+		{Name: "open-webui", URL: fmt.Sprintf("http://localhost:%d/health", openWebUIPort)},
+		{Name: "searxng", URL: fmt.Sprintf("http://localhost:%d/healthz", searxngPort)},
+	}
+	if config.Backend == backendLlamaCpp {
+		responses[0] = healthResponse{Name: "llama-server-health", serverPath: "/health"}
+		responses[1] = healthResponse{Name: "llama-server-models", serverPath: "/v1/models"}
+	}
+	for i := range responses {
+		func() {
+			ctx, cancel := context.WithTimeout(ctx, diagnoseHealthTimeout)
+			defer cancel()
+			var req *http.Request
+			var err error
+			if path := responses[i].serverPath; path != "" {
+				req, err = newServerRequest(ctx, http.MethodGet, path, nil)
+				responses[i].URL = getServerDisplayURL() + path
+			} else {
+				req, err = http.NewRequestWithContext(ctx, http.MethodGet, responses[i].URL, nil)
+			}
+			if err != nil {
+				responses[i].Error = err.Error()
+				return
+			}
+			resp, err := doWithRetry(ctx, req, healthRetryPolicy)
+			if err != nil {
+				responses[i].Error = err.Error()
+				return
+			}
+			defer resp.Body.Close()
+			responses[i].Status = resp.StatusCode
+			body, err := io.ReadAll(io.LimitReader(resp.Body, diagnoseMaxBody))
+			if err != nil {
+				responses[i].Error = err.Error()
+			}
+			responses[i].Body = string(body)
+		}()
+	}
+	return responses
+}
+
+// diagnosticsBundle writes files into a gzipped tar archive.
+type diagnosticsBundle struct {
+	dir string // Top level directory within the archive.
+	tw  *tar.Writer
+}
+
+// Add a file with the given contents to the bundle.
+func (b *diagnosticsBundle) add(name string, contents []byte) error {
+	header := &tar.Header{
+		Name:    b.dir + "/" + name,
+		Mode:    0o644,
+		Size:    int64(len(contents)),
+		ModTime: time.Now(),
+	}
+	if err := b.tw.WriteHeader(header); err != nil {
+		return fmt.Errorf("failed to add %s: %w", name, err)
+	}
+	if _, err := b.tw.Write(contents); err != nil {
+		return fmt.Errorf("failed to add %s: %w", name, err)
+	}
+	return nil
+}
+
+// Add a value to the bundle as a JSON file.  If err is set, it is recorded
+// instead of the value.
+func (b *diagnosticsBundle) addJSON(name string, value any, err error) error {
+	if err != nil {
+		value = map[string]string{"error": err.Error()}
+	}
+	buf, err := json.MarshalIndent(value, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to serialize %s: %w", name, err)
+	}
+	return b.add(name, append(buf, '\n'))
+}
+
+// Add the end of a file to the bundle; missing files are skipped.
+func (b *diagnosticsBundle) addFileTail(name, path string, limit int64) error {
+	file, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return b.add(name+".error", []byte(err.Error()))
+	}
+	defer file.Close()
+	if info, err := file.Stat(); err == nil && info.Size() > limit {
+		if _, err = file.Seek(-limit, io.SeekEnd); err != nil {
+			return b.add(name+".error", []byte(err.Error()))
+		}
+	}
+	buf, err := io.ReadAll(file)
+	if err != nil {
+		return b.add(name+".error", []byte(err.Error()))
+	}
+	return b.add(name, buf)
+}
+
+// Collect diagnostic information into a timestamped tar.gz file, and print
+// its path as JSON.
+func diagnose(ctx context.Context) error {
+	outputDir := diagnoseOutput
+	if outputDir == "" {
+		var err error
+		if outputDir, err = getLogLocation(ctx); err != nil {
+			return fmt.Errorf("failed to find log directory: %w", err)
+		}
+	}
+	if err := os.MkdirAll(outputDir, 0o755); err != nil {
+		return fmt.Errorf("failed to create output directory: %w", err)
+	}
+	name := "rd-open-webui-diagnostics-" + time.Now().UTC().Format("20060102T150405Z")
+	outputPath := filepath.Join(outputDir, name+".tar.gz")
+
+	// Build the archive in memory, so that a failure does not leave a partial
+	// file behind; the logs included are bounded in size.
+	var buf bytes.Buffer
+	gzipWriter := gzip.NewWriter(&buf)
+	bundle := &diagnosticsBundle{dir: name, tw: tar.NewWriter(gzipWriter)}
+
+	steps := []func() error{
+		func() error { return bundle.addJSON("version.json", getInstallerVersion(), nil) },
+		func() error { return bundle.addJSON("config.json", redactedConfig(), nil) },
+		func() error {
+			report, err := runPreflight(ctx)
+			return bundle.addJSON("preflight.json", report, err)
+		},
+		func() error { return bundle.addJSON("hardware.json", getHardwareInfo(), nil) },
+		func() error {
+			procs, err := findOllamaProcesses()
+			return bundle.addJSON("processes.json", procs, err)
+		},
+		func() error { return bundle.addJSON("ports.json", getPortOwners(ctx), nil) },
+		func() error { return bundle.addJSON("health.json", getHealthResponses(ctx), nil) },
+		func() error {
+			modelsDir, err := getModelsLocation(ctx)
+			if err != nil {
+				return bundle.addJSON("models.json", nil, err)
+			}
+			models, err := listLocalModels(modelsDir)
+			names := []string{}
+			for _, model := range models {
+				names = append(names, model.Name)
+			}
+			if os.IsNotExist(err) {
+				err = nil
+			}
+			return bundle.addJSON("models.json", map[string]any{"path": modelsDir, "models": names}, err)
+		},
+		func() error {
+			stateDir, err := getStateLocation(ctx)
+			if err != nil {
+				return bundle.addJSON("state.error.json", nil, err)
+			}
+			for _, stateFile := range []string{serverPIDFileName, pullStateFileName, lockOwnerFileName, updateCheckFileName} {
+				if err = bundle.addFileTail("state/"+stateFile, filepath.Join(stateDir, stateFile), diagnoseLogTail); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+		func() error {
+			logDir, err := getLogLocation(ctx)
+			if err != nil {
+				return bundle.addJSON("logs.error.json", nil, err)
+			}
+			entries, err := os.ReadDir(logDir)
+			if err != nil && !os.IsNotExist(err) {
+				return bundle.addJSON("logs.error.json", nil, err)
+			}
+			for _, entry := range entries {
+				// Skip earlier diagnostics bundles written to the same directory.
+				if !entry.Type().IsRegular() || strings.HasSuffix(entry.Name(), ".tar.gz") {
+					continue
+				}
+				if err = bundle.addFileTail("logs/"+entry.Name(), filepath.Join(logDir, entry.Name()), diagnoseLogTail); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	}
+	for _, step := range steps {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := step(); err != nil {
+			return fmt.Errorf("failed to collect diagnostics: %w", err)
+		}
+	}
+	if err := bundle.tw.Close(); err != nil {
+		return fmt.Errorf("failed to write diagnostics: %w", err)
+	}
+	if err := gzipWriter.Close(); err != nil {
+		return fmt.Errorf("failed to write diagnostics: %w", err)
+	}
+	if err := os.WriteFile(outputPath, buf.Bytes(), 0o600); err != nil {
+		return fmt.Errorf("failed to write diagnostics: %w", err)
+	}
+
+	log.Printf("Wrote diagnostics to %s", outputPath)
+	if err := json.NewEncoder(os.Stdout).Encode(map[string]string{"path": outputPath}); err != nil {
+		return fmt.Errorf("failed to output diagnostics path: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,350 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	// The most connections an asset may be downloaded over.
+	maxDownloadConnections = 16
+	// The size of each range requested when downloading over multiple
+	// connections; this much is buffered in memory per connection.
+	downloadChunkSize = 8 << 20
+	// Assets smaller than this are always downloaded over one connection.
+	minParallelDownloadSize = 4 * downloadChunkSize
+	// How often to log download progress.
+	downloadProgressInterval = 10 * time.Second
+)
+
+// assetDownload is an in-progress download of a release asset; the data is
+// hashed as it is read.
+type assetDownload struct {
+	io.Reader
+	body   io.Closer
+	cancel context.CancelFunc
+	hasher hash.Hash
+	asset  *assetInfo
+}
+
+// Start downloading the asset.  If the server supports range requests, large
+// assets are downloaded over multiple connections.  The download is limited to
+// the configured rate.  The caller must close the download; closing it stops
+// any read in progress.
+func downloadAsset(ctx context.Context, asset *assetInfo) (result *assetDownload, err error) {
+	log.Printf("Downloading %s from %s...", asset.Name, asset.URL)
+	ctx, cancel := context.WithCancel(ctx)
+	defer func() {
+		if err != nil {
+			cancel()
+		}
+	}()
+	limiter := newDownloadRateLimiter()
+	size := asset.Size
+	var body io.ReadCloser
+	var reader io.Reader
+	connections := limiter.connections(config.Download.Connections)
+	if connections < config.Download.Connections {
+		log.Printf("Using %d of %d connections, as the download rate limit is low.", connections, config.Download.Connections)
+	}
+	if connections > 1 {
+		if rangeSize := getRangeSupport(ctx, asset.URL); rangeSize >= minParallelDownloadSize {
+			log.Printf("Downloading %s over %d connections...", formatBytes(rangeSize), connections)
+			size = rangeSize
+			body = startRangeDownload(ctx, asset.URL, size, connections, limiter)
+			reader = body
+		}
+	}
+	if body == nil {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, asset.URL, nil)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create request: %w", err)
+		}
+		resp, err := doWithRetry(ctx, req, remoteRetryPolicy)
+		if err != nil {
+			return nil, fmt.Errorf("failed to download %s: %w", asset.Name, err)
+		}
+		if resp.StatusCode >= 300 {
+			resp.Body.Close()
+			return nil, fmt.Errorf("error downloading %s: status %s", asset.Name, resp.Status)
+		}
+		body = resp.Body
+		reader = body
+		if limiter != nil {
+			reader = &rateLimitedReader{ctx: ctx, r: body, limiter: limiter}
+		}
+		if resp.ContentLength > 0 {
+			size = resp.ContentLength
+		}
+	}
+	progress := &downloadProgress{r: reader, total: size, limiter: limiter, lastTime: time.Now()}
+	hasher := sha256.New()
+	return &assetDownload{
+		Reader: io.TeeReader(progress, hasher),
+		body:   body,
+		cancel: cancel,
+		hasher: hasher,
+		asset:  asset,
+	}, nil
+}
+
+// Stop downloading.  This may be called while another goroutine is reading.
+func (d *assetDownload) Close() error {
+	d.cancel()
+	return d.body.Close()
+}
+
+// Read the rest of the download, and check it against the expected digest of
+// the asset, if known.  Returns the digest of the data.
+func (d *assetDownload) finish() (string, error) {
+	// Archive readers may stop before the end of the data (e.g. trailers).
+	if _, err := io.Copy(io.Discard, d); err != nil {
+		return "", fmt.Errorf("failed to download %s: %w", d.asset.Name, err)
+	}
+	digest := "sha256:" + hex.EncodeToString(d.hasher.Sum(nil))
+	if d.asset.Digest != "" && d.asset.Digest != digest {
+		return "", fmt.Errorf("downloaded %s has digest %s, expected %s", d.asset.Name, digest, d.asset.Digest)
+	}
+	return digest, nil
+}
+
+// downloadProgress logs the progress of a download periodically, along with
+// the rate it is being downloaded at.
+type downloadProgress struct {
+	r        io.Reader
+	total    int64 // Zero if unknown.
+	limiter  *rateLimiter
+	read     int64
+	lastTime time.Time // When progress was last logged.
+	lastRead int64
+}
+
+func (p *downloadProgress) Read(buf []byte) (int, error) {
+	n, err := p.r.Read(buf)
+	p.read += int64(n)
+	if elapsed := time.Since(p.lastTime); elapsed >= downloadProgressInterval {
+		rate := int64(float64(p.read-p.lastRead) / elapsed.Seconds())
+		message := fmt.Sprintf("Downloaded %s", formatBytes(p.read))
+		if p.total > 0 {
+			message += fmt.Sprintf(" of %s (%d%%)", formatBytes(p.total), p.read*100/p.total)
+		}
+		message += fmt.Sprintf(" at %s/s", formatBytes(rate))
+		if limit := p.limiter.limit(); limit > 0 {
+			message += fmt.Sprintf(", limited to %s", describeRate(limit))
+		}
+		log.Print(message + ".")
+		p.lastTime, p.lastRead = time.Now(), p.read
+	}
+	return n, err
+}
+
+// Check if the server advertises support for range requests for the URL;
+// returns the size of the content if so, or zero otherwise.
+func getRangeSupport(ctx context.Context, url string) int64 {
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, url, nil)
+	if err != nil {
+		return 0
+	}
+	resp, err := doWithRetry(ctx, req, remoteRetryPolicy)
+	if err != nil {
+		log.Printf("Failed to check for range support, using one connection: %s", err)
+		return 0
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 || !strings.Contains(resp.Header.Get("Accept-Ranges"), "bytes") || resp.ContentLength <= 0 {
+		return 0
+	}
+	return resp.ContentLength
+}
+
+// errRangeIgnored is returned by fetchRange if the server responded with the
+// whole content rather than the range requested.
+var errRangeIgnored = errors.New("server ignored the range request")
+
+// rangeDownload downloads a URL in chunks over several connections using range
+// requests; reading it returns the chunks in order.  If the server turns out
+// to ignore range requests, it falls back to a single connection.
+type rangeDownload struct {
+	ctx         context.Context
+	cancel      context.CancelFunc
+	cancelRange context.CancelFunc // Stops the range requests only.
+	url         string
+	limiter     *rateLimiter
+	// chunks receives the result of each chunk, in order.  It is buffered to
+	// limit how far ahead of the reader the download can get.
+	chunks   chan chan rangeChunk
+	current  []byte // The unread part of the current chunk.
+	read     int64  // Bytes returned so far.
+	fallback io.ReadCloser
+	err      error
+}
+
+type rangeChunk struct {
+	data []byte
+	err  error
+}
+
+// Start downloading the URL, which has the given size.  The limiter applies
+// to all of the connections together.
+func startRangeDownload(ctx context.Context, url string, size int64, connections int, limiter *rateLimiter) *rangeDownload {
+	ctx, cancel := context.WithCancel(ctx)
+	d := &rangeDownload{ctx: ctx, cancel: cancel, url: url, limiter: limiter, chunks: make(chan chan rangeChunk, connections)}
+	ctx, d.cancelRange = context.WithCancel(ctx)
+	slots := make(chan struct{}, connections)
+	go func() {
+		defer close(d.chunks)
+		for offset := int64(0); offset < size; offset += downloadChunkSize {
+			length := min(downloadChunkSize, size-offset)
+			result := make(chan rangeChunk, 1)
+			select {
+			case d.chunks <- result:
+			case <-ctx.Done():
+				return
+			}
+			select {
+			case slots <- struct{}{}:
+			case <-ctx.Done():
+				return
+			}
+			go func(offset, length int64) {
+				defer func() { <-slots }()
+				data, err := fetchRange(ctx, url, offset, length, limiter)
+				result <- rangeChunk{data: data, err: err}
+			}(offset, length)
+		}
+	}()
+	return d
+}
+
+func (d *rangeDownload) Read(p []byte) (int, error) {
+	for len(d.current) == 0 {
+		if d.fallback != nil {
+			n, err := d.fallback.Read(p)
+			d.read += int64(n)
+			if err != nil {
+				d.fallback.Close()
+				d.fallback, d.err = nil, err
+			}
+			return n, err
+		}
+		if d.err != nil {
+			return 0, d.err
+		}
+		result, ok := <-d.chunks
+		if !ok {
+			d.err = io.EOF
+			if err := d.ctx.Err(); err != nil {
+				d.err = err
+			}
+			continue
+		}
+		select {
+		case chunk := <-result:
+			d.current, d.err = chunk.data, chunk.err
+			if errors.Is(d.err, errRangeIgnored) {
+				d.err = d.startFallback()
+			}
+		case <-d.ctx.Done():
+			d.err = d.ctx.Err()
+		}
+	}
+	n := copy(p, d.current)
+	d.current = d.current[n:]
+	d.read += int64(n)
+	return n, nil
+}
+
+// Abandon the range requests, and continue the download over a single
+// connection, skipping the data that has already been read.
+func (d *rangeDownload) startFallback() error {
+	log.Printf("The server ignored a range request; downloading over one connection instead...")
+	d.cancelRange()
+	req, err := http.NewRequestWithContext(d.ctx, http.MethodGet, d.url, nil)
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	resp, err := doWithRetry(d.ctx, req, remoteRetryPolicy)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode >= 300 {
+		resp.Body.Close()
+		return fmt.Errorf("download returned status %s", resp.Status)
+	}
+	var body io.Reader = resp.Body
+	if d.limiter != nil {
+		body = &rateLimitedReader{ctx: d.ctx, r: resp.Body, limiter: d.limiter}
+	}
+	if _, err = io.CopyN(io.Discard, body, d.read); err != nil {
+		resp.Body.Close()
+		return fmt.Errorf("failed to skip %d bytes already downloaded: %w", d.read, err)
+	}
+	d.fallback = struct {
+		io.Reader
+		io.Closer
+	}{body, resp.Body}
+	return nil
+}
+
+// Stop downloading; any chunks still being downloaded are abandoned.  This may
+// be called while another goroutine is reading.
+func (d *rangeDownload) Close() error {
+	d.cancel()
+	return nil
+}
+
+// Download part of the URL.  Failures partway through are retried, as well as
+// failed requests.
+func fetchRange(ctx context.Context, url string, offset, length int64, limiter *rateLimiter) ([]byte, error) {
+	for attempt := 1; ; attempt++ {
+		data, err := func() ([]byte, error) {
+			req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+			if err != nil {
+				return nil, err
+			}
+			req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, offset+length-1))
+			resp, err := doWithRetry(ctx, req, remoteRetryPolicy)
+			if err != nil {
+				return nil, err
+			}
+			defer resp.Body.Close()
+			if resp.StatusCode == http.StatusOK {
+				return nil, errRangeIgnored
+			}
+			if resp.StatusCode != http.StatusPartialContent {
+				return nil, fmt.Errorf("range request returned status %s", resp.Status)
+			}
+			var body io.Reader = resp.Body
+			if limiter != nil {
+				body = &rateLimitedReader{ctx: ctx, r: resp.Body, limiter: limiter}
+			}
+			data := make([]byte, length)
+			if _, err = io.ReadFull(body, data); err != nil {
+				return nil, err
+			}
+			return data, nil
+		}()
+		if err == nil || ctx.Err() != nil || errors.Is(err, errRangeIgnored) || attempt >= remoteRetryPolicy.Attempts {
+			if err != nil {
+				err = fmt.Errorf("failed to download bytes %d-%d: %w", offset, offset+length-1, err)
+			}
+			return data, err
+		}
+		delay := remoteRetryPolicy.delay(attempt)
+		log.Printf("Download of bytes %d-%d failed (%s); retrying in %s...", offset, offset+length-1, err, delay.Round(time.Millisecond))
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(delay):
+		}
+	}
+}
@@ -0,0 +1,395 @@
+package main
+
+import (
+	"archive/tar"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/klauspost/pgzip"
+	"github.com/xenking/zipstream"
+)
+
+// extractLimits bounds what an archive may contain.
+type extractLimits struct {
+	MaxSize    int64 // Total size of all regular files, in bytes.
+	MaxEntries int   // Number of entries of any type.
+}
+
+// Limits for the ollama release archives; these are far larger than the real
+// archives, and only exist to stop malformed ones from filling the disk.
+var ollamaExtractLimits = extractLimits{MaxSize: 32 << 30, MaxEntries: 10000}
+
+// Permission bits that extracted files and directories may have; setuid,
+// setgid, sticky and group/world write bits are always dropped.
+const extractPermMask fs.FileMode = 0o755
+
+// errInsecureArchive is returned for archives that try to write outside the
+// destination, or otherwise break the rules.
+var errInsecureArchive = errors.New("insecure archive")
+
+// extractor writes archive entries below a root directory, ensuring nothing
+// is written outside of it.  Links are created last, once their targets
+// exist.
+type extractor struct {
+	root    string
+	limits  extractLimits
+	include func(name string) bool // If set, only matching non-directories are extracted.
+	entries int
+	size    int64
+	links   []pendingLink
+	// The names of all symbolic links in the archive, cleaned.
+	symlinks map[string]bool
+}
+
+type pendingLink struct {
+	name   string
+	target string
+	hard   bool
+}
+
+func newExtractor(root string, limits extractLimits, include func(name string) bool) *extractor {
+	return &extractor{root: root, limits: limits, include: include, symlinks: make(map[string]bool)}
+}
+
+// Check an entry name and get the path to write it to.  The name must be
+// local, and none of its parent directories may be symbolic links.
+func (e *extractor) path(name string) (string, error) {
+	if !filepath.IsLocal(name) || strings.ContainsRune(name, '\\') {
+		return "", fmt.Errorf("%s: %w", name, errInsecureArchive)
+	}
+	name = filepath.Clean(name)
+	parts := strings.Split(name, string(filepath.Separator))
+	current := e.root
+	for _, part := range parts[:len(parts)-1] {
+		current = filepath.Join(current, part)
+		info, err := os.Lstat(current)
+		if errors.Is(err, os.ErrNotExist) {
+			break
+		} else if err != nil {
+			return "", fmt.Errorf("%s: %w", name, err)
+		}
+		if !info.IsDir() {
+			return "", fmt.Errorf("%s: parent %s is not a directory: %w", name, part, errInsecureArchive)
+		}
+	}
+	return filepath.Join(e.root, name), nil
+}
+
+// Count an entry against the limits.
+func (e *extractor) count(name string) error {
+	e.entries++
+	if e.limits.MaxEntries > 0 && e.entries > e.limits.MaxEntries {
+		return fmt.Errorf("%s: archive has more than %d entries: %w", name, e.limits.MaxEntries, errInsecureArchive)
+	}
+	return nil
+}
+
+func (e *extractor) included(name string) bool {
+	return e.include == nil || e.include(filepath.Clean(name))
+}
+
+// Remove whatever exists at the path, unless it is a directory; files are
+// always created afresh so that existing links are never followed.
+func removeExisting(path string) error {
+	info, err := os.Lstat(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		return fmt.Errorf("%s is a directory", path)
+	}
+	return os.Remove(path)
+}
+
+// Create a directory.
+func (e *extractor) dir(name string, mode fs.FileMode) error {
+	if err := e.count(name); err != nil {
+		return err
+	}
+	path, err := e.path(name)
+	if err != nil {
+		return err
+	}
+	perm := mode.Perm()&extractPermMask | 0o700
+	if err = os.MkdirAll(path, perm); err != nil {
+		return fmt.Errorf("error extracting %s: failed to make directory: %w", name, err)
+	}
+	if err = os.Chmod(path, perm); err != nil {
+		return fmt.Errorf("error extracting %s: failed to change permissions: %w", name, err)
+	}
+	return nil
+}
+
+// Create a regular file from the reader; size is -1 if it is not known in
+// advance.
+func (e *extractor) file(name string, mode fs.FileMode, size int64, r io.Reader) error {
+	if err := e.count(name); err != nil {
+		return err
+	}
+	remaining := int64(math.MaxInt64 - 1)
+	if e.limits.MaxSize > 0 {
+		remaining = e.limits.MaxSize - e.size
+	}
+	if size > remaining {
+		return fmt.Errorf("%s: archive contents are larger than %d bytes: %w", name, e.limits.MaxSize, errInsecureArchive)
+	}
+	path, err := e.path(name)
+	if err != nil {
+		return err
+	}
+	if !e.included(name) {
+		// Still count the size, so the limit does not depend on the filter.
+		n, err := io.Copy(io.Discard, io.LimitReader(r, remaining+1))
+		if err != nil {
+			return fmt.Errorf("error reading %s: %w", name, err)
+		}
+		if n > remaining {
+			return fmt.Errorf("%s: archive contents are larger than %d bytes: %w", name, e.limits.MaxSize, errInsecureArchive)
+		}
+		e.size += n
+		return nil
+	}
+	if err = os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return fmt.Errorf("error extracting %s: failed to create parent: %w", name, err)
+	}
+	// Replace the file rather than writing into it, in case it is in use.
+	if err = removeExisting(path); err != nil {
+		return fmt.Errorf("error extracting %s: failed to remove existing file: %w", name, err)
+	}
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, mode.Perm()&extractPermMask|0o600)
+	if err != nil {
+		return fmt.Errorf("error extracting %s: failed to create file: %w", name, err)
+	}
+	// Read one extra byte to detect entries larger than they claim to be.
+	n, err := io.Copy(file, io.LimitReader(r, remaining+1))
+	closeErr := file.Close()
+	if err != nil {
+		return fmt.Errorf("error extracting %s: failed to copy: %w", name, err)
+	}
+	if closeErr != nil {
+		return fmt.Errorf("error extracting %s: failed to write: %w", name, closeErr)
+	}
+	if n > remaining {
+		return fmt.Errorf("%s: archive contents are larger than %d bytes: %w", name, e.limits.MaxSize, errInsecureArchive)
+	}
+	if size >= 0 && n != size {
+		return fmt.Errorf("error extracting %s: extracted %d of %d bytes", name, n, size)
+	}
+	e.size += n
+	return nil
+}
+
+// Record a symbolic link to create.  The target must be relative, and must
+// stay within the root when resolved relative to the link's directory; it is
+// created exactly as given.  Targets passing through other links are rejected
+// by finish, once all the links in the archive are known.
+func (e *extractor) symlink(name, target string) error {
+	if err := e.count(name); err != nil {
+		return err
+	}
+	if _, err := e.path(name); err != nil {
+		return err
+	}
+	resolved := filepath.Join(filepath.Dir(filepath.Clean(name)), target)
+	if filepath.IsAbs(target) || strings.ContainsRune(target, '\\') || !filepath.IsLocal(resolved) {
+		return fmt.Errorf("%s: link target %s: %w", name, target, errInsecureArchive)
+	}
+	e.symlinks[filepath.Clean(name)] = true
+	if e.included(name) {
+		e.links = append(e.links, pendingLink{name: name, target: target})
+	}
+	return nil
+}
+
+// Record a hard link to create; the target is relative to the root, as in tar
+// archives, and must be a regular file from the archive.
+func (e *extractor) hardlink(name, target string) error {
+	if err := e.count(name); err != nil {
+		return err
+	}
+	if _, err := e.path(name); err != nil {
+		return err
+	}
+	if !filepath.IsLocal(target) || strings.ContainsRune(target, '\\') {
+		return fmt.Errorf("%s: link target %s: %w", name, target, errInsecureArchive)
+	}
+	if e.included(name) {
+		e.links = append(e.links, pendingLink{name: name, target: target, hard: true})
+	}
+	return nil
+}
+
+// Check that the directories a symbolic link's target passes through are not
+// themselves symbolic links, either from the archive or already on disk.  The
+// target is only checked as text, so a link part way along it could lead a
+// later ".." outside the root.
+func (e *extractor) checkLinkTarget(link pendingLink) error {
+	current := filepath.Dir(filepath.Clean(link.name))
+	parts := strings.Split(link.target, "/")
+	for _, part := range parts[:len(parts)-1] {
+		switch part {
+		case "", ".":
+			continue
+		case "..":
+			current = filepath.Dir(current)
+			continue
+		}
+		current = filepath.Join(current, part)
+		isLink := e.symlinks[current]
+		if info, err := os.Lstat(filepath.Join(e.root, current)); err == nil && info.Mode()&fs.ModeSymlink != 0 {
+			isLink = true
+		}
+		if isLink {
+			return fmt.Errorf("%s: link target %s passes through link %s: %w", link.name, link.target, current, errInsecureArchive)
+		}
+	}
+	return nil
+}
+
+// Create the links recorded while extracting.  Symbolic link targets are all
+// checked first, as a link may come before the links its target passes
+// through.
+func (e *extractor) finish() error {
+	for _, link := range e.links {
+		if link.hard {
+			continue
+		}
+		if err := e.checkLinkTarget(link); err != nil {
+			return err
+		}
+	}
+	for _, link := range e.links {
+		path, err := e.path(link.name)
+		if err != nil {
+			return err
+		}
+		if err = os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			return fmt.Errorf("error extracting %s: failed to create parent: %w", link.name, err)
+		}
+		if err = removeExisting(path); err != nil {
+			return fmt.Errorf("error extracting %s: failed to remove existing file: %w", link.name, err)
+		}
+		if link.hard {
+			targetPath, err := e.path(link.target)
+			if err != nil {
+				return err
+			}
+			info, err := os.Lstat(targetPath)
+			if err != nil {
+				return fmt.Errorf("error extracting %s: link target: %w", link.name, err)
+			}
+			if !info.Mode().IsRegular() {
+				return fmt.Errorf("%s: link target %s is not a regular file: %w", link.name, link.target, errInsecureArchive)
+			}
+			err = os.Link(targetPath, path)
+		} else {
+			err = os.Symlink(link.target, path)
+		}
+		if err != nil {
+			return fmt.Errorf("error extracting %s: could not create link: %w", link.name, err)
+		}
+	}
+	return nil
+}
+
+const (
+	// The size and number of blocks that are decompressed ahead of extraction.
+	gzipBlockSize = 1 << 20
+	gzipBlocks    = 4
+)
+
+// Extract a gzipped tar archive below root.  If include is set, only the
+// non-directory entries (named relative to root) for which it returns true
+// are extracted, replacing any existing files.  The archive is decompressed
+// ahead of extraction in a separate goroutine, with its checksum calculated
+// in parallel; if extraction fails and the reader is an io.Closer, it is
+// closed so that the read in progress does not hold up returning.
+func extractTarGz(ctx context.Context, r io.Reader, root string, limits extractLimits, include func(name string) bool) (err error) {
+	gzipReader, err := pgzip.NewReaderN(r, gzipBlockSize, gzipBlocks)
+	if err != nil {
+		return fmt.Errorf("failed to read gzip archive: %w", err)
+	}
+	defer func() {
+		if closer, ok := r.(io.Closer); ok && err != nil {
+			_ = closer.Close()
+		}
+		_ = gzipReader.Close()
+	}()
+	e := newExtractor(root, limits, include)
+	tarReader := tar.NewReader(gzipReader)
+	for {
+		if err = ctx.Err(); err != nil {
+			return err
+		}
+		header, err := tarReader.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("error reading tar archive: %w", err)
+		}
+		switch header.Typeflag {
+		case tar.TypeDir:
+			err = e.dir(header.Name, header.FileInfo().Mode())
+		case tar.TypeReg:
+			err = e.file(header.Name, header.FileInfo().Mode(), header.Size, tarReader)
+		case tar.TypeSymlink:
+			err = e.symlink(header.Name, header.Linkname)
+		case tar.TypeLink:
+			err = e.hardlink(header.Name, header.Linkname)
+		default:
+			err = fmt.Errorf("error extracting %s: don't know how to handle %v", header.Name, header.Typeflag)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return e.finish()
+}
+
+// Extract a zip archive below root, reading it as a stream.  The include
+// function is as for extractTarGz.
+func extractZip(ctx context.Context, r io.Reader, root string, limits extractLimits, include func(name string) bool) error {
+	e := newExtractor(root, limits, include)
+	zipReader := zipstream.NewReader(r)
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		header, err := zipReader.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("error reading zip archive: %w", err)
+		}
+		// The local headers read when streaming do not have file modes, so
+		// entries can only be directories or regular files.
+		if strings.HasSuffix(header.Name, "/") {
+			err = e.dir(header.Name, 0o755)
+		} else {
+			if header.UncompressedSize64 > math.MaxInt64 {
+				return fmt.Errorf("%s: invalid size: %w", header.Name, errInsecureArchive)
+			}
+			size := int64(header.UncompressedSize64)
+			if header.Flags&0x8 != 0 {
+				// The size is in a data descriptor after the contents.
+				size = -1
+			}
+			err = e.file(header.Name, 0o644, size, zipReader)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return e.finish()
+}
@@ -0,0 +1,340 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+// Limits used by the tests, small enough that fuzzing stays fast.
+var testExtractLimits = extractLimits{MaxSize: 1 << 20, MaxEntries: 100}
+
+// testEntry is an archive entry for building test archives.
+type testEntry struct {
+	name   string
+	body   string
+	link   string // Target, for symbolic and hard links.
+	mode   int64
+	kind   byte // A tar type flag.
+	size   int64
+	hasLen bool // Whether size overrides the length of the body.
+}
+
+func makeTarGz(t testing.TB, entries ...testEntry) []byte {
+	var buf bytes.Buffer
+	gzipWriter := gzip.NewWriter(&buf)
+	tarWriter := tar.NewWriter(gzipWriter)
+	for _, entry := range entries {
+		header := &tar.Header{
+			Name:     entry.name,
+			Linkname: entry.link,
+			Mode:     entry.mode,
+			Typeflag: entry.kind,
+			Size:     int64(len(entry.body)),
+		}
+		if header.Mode == 0 {
+			header.Mode = 0o644
+		}
+		if header.Typeflag == 0 {
+			header.Typeflag = tar.TypeReg
+		}
+		if header.Typeflag != tar.TypeReg {
+			header.Size = 0
+		}
+		if entry.hasLen {
+			header.Size = entry.size
+		}
+		if err := tarWriter.WriteHeader(header); err != nil {
+			t.Fatalf("failed to write %s: %s", entry.name, err)
+		}
+		// Short writes are expected for entries that lie about their size.
+		_, _ = tarWriter.Write([]byte(entry.body))
+	}
+	// Archives with entries that lie about their size cannot be closed.
+	_ = tarWriter.Flush()
+	_ = tarWriter.Close()
+	if err := gzipWriter.Close(); err != nil {
+		t.Fatalf("failed to write archive: %s", err)
+	}
+	return buf.Bytes()
+}
+
+// Check if the entries can be written to a zip archive, which only has files
+// and directories when streamed.
+func zipCompatible(entries []testEntry) bool {
+	for _, entry := range entries {
+		if entry.hasLen || (entry.kind != 0 && entry.kind != tar.TypeReg && entry.kind != tar.TypeDir) {
+			return false
+		}
+	}
+	return true
+}
+
+func makeZip(t testing.TB, entries ...testEntry) []byte {
+	var buf bytes.Buffer
+	zipWriter := zip.NewWriter(&buf)
+	for _, entry := range entries {
+		writer, err := zipWriter.CreateHeader(&zip.FileHeader{Name: entry.name, Method: zip.Deflate})
+		if err != nil {
+			t.Fatalf("failed to write %s: %s", entry.name, err)
+		}
+		if _, err = writer.Write([]byte(entry.body)); err != nil {
+			t.Fatalf("failed to write %s: %s", entry.name, err)
+		}
+	}
+	if err := zipWriter.Close(); err != nil {
+		t.Fatalf("failed to write archive: %s", err)
+	}
+	return buf.Bytes()
+}
+
+// Archives that must be rejected.
+var hostileArchives = []struct {
+	name    string
+	entries []testEntry
+}{
+	{"parent traversal", []testEntry{{name: "../escape", body: "x"}}},
+	{"nested traversal", []testEntry{{name: "lib/../../escape", body: "x"}}},
+	{"absolute path", []testEntry{{name: "/tmp/escape", body: "x"}}},
+	{"absolute symlink", []testEntry{{name: "lib/link", kind: tar.TypeSymlink, link: "/etc/passwd"}}},
+	{"escaping symlink", []testEntry{{name: "lib/link", kind: tar.TypeSymlink, link: "../../escape"}}},
+	{"file below a symlink", []testEntry{
+		{name: "lib", kind: tar.TypeSymlink, link: "."},
+		{name: "lib/escape", body: "x"},
+	}},
+	{"write through symlinked directory", []testEntry{
+		{name: "dir", kind: tar.TypeDir},
+		{name: "dir/up", kind: tar.TypeSymlink, link: ".."},
+		{name: "dir/up/up2", kind: tar.TypeSymlink, link: ".."},
+	}},
+	{"chained symlinks", []testEntry{
+		{name: "sub", kind: tar.TypeDir},
+		{name: "sub/l1", kind: tar.TypeSymlink, link: ".."},
+		{name: "a", kind: tar.TypeSymlink, link: "sub/l1/../secret"},
+	}},
+	{"chained symlinks in reverse order", []testEntry{
+		{name: "a", kind: tar.TypeSymlink, link: "sub/l1/../secret"},
+		{name: "sub", kind: tar.TypeDir},
+		{name: "sub/l1", kind: tar.TypeSymlink, link: ".."},
+	}},
+	{"escaping hard link", []testEntry{{name: "link", kind: tar.TypeLink, link: "../escape"}}},
+	{"device", []testEntry{{name: "dev", kind: tar.TypeChar}}},
+	{"too large", []testEntry{{name: "big", body: strings.Repeat("x", int(testExtractLimits.MaxSize)+1)}}},
+	{"too many entries", func() []testEntry {
+		var entries []testEntry
+		for i := 0; i <= testExtractLimits.MaxEntries; i++ {
+			entries = append(entries, testEntry{name: "dir/", kind: tar.TypeDir})
+		}
+		return entries
+	}()},
+	{"short entry", []testEntry{{name: "short", body: "x", size: 10, hasLen: true}}},
+}
+
+// Resolve the target of the link at path through the filesystem, following any
+// links it passes through.  The last part of the target need not exist; if the
+// rest does not either, the target is resolved as text.
+func resolveLinkTarget(path, target string) string {
+	dir, base := filepath.Dir(path), target
+	if i := strings.LastIndex(target, "/"); i >= 0 {
+		// Join would clean the path, removing ".." before links are followed.
+		dir, base = dir+string(filepath.Separator)+filepath.FromSlash(target[:i+1]), target[i+1:]
+	}
+	if resolvedDir, err := filepath.EvalSymlinks(dir); err == nil {
+		dir = resolvedDir
+	} else if resolvedDir, err = filepath.EvalSymlinks(filepath.Dir(path)); err == nil {
+		return filepath.Join(resolvedDir, target)
+	}
+	resolved := filepath.Join(dir, base)
+	if final, err := filepath.EvalSymlinks(resolved); err == nil {
+		return final
+	}
+	return resolved
+}
+
+// Check that extracting an archive into root/ wrote nothing outside of it, and
+// that everything inside is safe.
+func checkExtracted(t *testing.T, parent string) {
+	t.Helper()
+	root := filepath.Join(parent, "root")
+	entries, err := os.ReadDir(parent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		if entry.Name() != "root" {
+			t.Errorf("extracted outside the root: %s", entry.Name())
+		}
+	}
+	realRoot, err := filepath.EvalSymlinks(root)
+	if errors.Is(err, fs.ErrNotExist) {
+		return
+	} else if err != nil {
+		t.Fatal(err)
+	}
+	err = filepath.WalkDir(root, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		if info.Mode()&fs.ModeSymlink == 0 {
+			if info.Mode()&(fs.ModeSetuid|fs.ModeSetgid|fs.ModeSticky) != 0 || info.Mode().Perm()&^extractPermMask != 0 {
+				t.Errorf("%s has unsafe mode %v", path, info.Mode())
+			}
+			return nil
+		}
+		target, err := os.Readlink(path)
+		if err != nil {
+			return err
+		}
+		if filepath.IsAbs(target) {
+			t.Errorf("%s has absolute target %s", path, target)
+		}
+		resolved, err := filepath.Rel(realRoot, resolveLinkTarget(path, target))
+		if err != nil || !filepath.IsLocal(resolved) {
+			t.Errorf("%s has target %s outside the root", path, target)
+		}
+		return nil
+	})
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		t.Fatal(err)
+	}
+}
+
+func TestExtractTarGz(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("symbolic links need extra privileges on Windows")
+	}
+	archive := makeTarGz(t,
+		testEntry{name: "bin/", kind: tar.TypeDir, mode: 0o7777},
+		testEntry{name: "bin/ollama", body: "binary", mode: 0o4777},
+		testEntry{name: "lib/ollama/libfoo.so.1.2", body: "library"},
+		testEntry{name: "lib/ollama/libfoo.so.1", kind: tar.TypeSymlink, link: "libfoo.so.1.2"},
+		testEntry{name: "lib/ollama/libfoo.so", kind: tar.TypeSymlink, link: "../ollama/libfoo.so.1"},
+		testEntry{name: "bin/hardlink", kind: tar.TypeLink, link: "bin/ollama"},
+	)
+	parent := t.TempDir()
+	root := filepath.Join(parent, "root")
+	if err := extractTarGz(context.Background(), bytes.NewReader(archive), root, testExtractLimits, nil); err != nil {
+		t.Fatal(err)
+	}
+	checkExtracted(t, parent)
+
+	// Relative link targets are kept as they are in the archive.
+	for name, want := range map[string]string{
+		"lib/ollama/libfoo.so.1": "libfoo.so.1.2",
+		"lib/ollama/libfoo.so":   "../ollama/libfoo.so.1",
+	} {
+		target, err := os.Readlink(filepath.Join(root, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if target != want {
+			t.Errorf("%s links to %s, expected %s", name, target, want)
+		}
+	}
+	info, err := os.Stat(filepath.Join(root, "bin", "ollama"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode() != 0o755 {
+		t.Errorf("bin/ollama has mode %v, expected %v", info.Mode(), fs.FileMode(0o755))
+	}
+	if contents, err := os.ReadFile(filepath.Join(root, "lib", "ollama", "libfoo.so")); err != nil || string(contents) != "library" {
+		t.Errorf("failed to read through link: %q, %v", contents, err)
+	}
+
+	// Extracting only some files replaces just those.
+	if err = os.WriteFile(filepath.Join(root, "bin", "ollama"), []byte("damaged"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Remove(filepath.Join(root, "lib", "ollama", "libfoo.so")); err != nil {
+		t.Fatal(err)
+	}
+	include := func(name string) bool {
+		return name == filepath.Join("bin", "ollama") || name == filepath.Join("lib", "ollama", "libfoo.so")
+	}
+	if err = extractTarGz(context.Background(), bytes.NewReader(archive), root, testExtractLimits, include); err != nil {
+		t.Fatal(err)
+	}
+	if contents, err := os.ReadFile(filepath.Join(root, "bin", "ollama")); err != nil || string(contents) != "binary" {
+		t.Errorf("bin/ollama was not replaced: %q, %v", contents, err)
+	}
+	if target, err := os.Readlink(filepath.Join(root, "lib", "ollama", "libfoo.so")); err != nil || target != "../ollama/libfoo.so.1" {
+		t.Errorf("lib/ollama/libfoo.so was not restored: %q, %v", target, err)
+	}
+}
+
+func TestExtractHostile(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("symbolic links need extra privileges on Windows")
+	}
+	for _, test := range hostileArchives {
+		t.Run(test.name, func(t *testing.T) {
+			parent := t.TempDir()
+			root := filepath.Join(parent, "root")
+			err := extractTarGz(context.Background(), bytes.NewReader(makeTarGz(t, test.entries...)), root, testExtractLimits, nil)
+			if err == nil {
+				t.Errorf("tar archive was extracted")
+			}
+			checkExtracted(t, parent)
+		})
+		if !zipCompatible(test.entries) {
+			continue
+		}
+		t.Run(test.name+" zip", func(t *testing.T) {
+			parent := t.TempDir()
+			root := filepath.Join(parent, "root")
+			err := extractZip(context.Background(), bytes.NewReader(makeZip(t, test.entries...)), root, testExtractLimits, nil)
+			if err == nil {
+				t.Errorf("zip archive was extracted")
+			}
+			checkExtracted(t, parent)
+		})
+	}
+}
+
+func FuzzExtractTarGz(f *testing.F) {
+	if runtime.GOOS == "windows" {
+		f.Skip("symbolic links need extra privileges on Windows")
+	}
+	f.Add(makeTarGz(f, testEntry{name: "bin/ollama", body: "binary", mode: 0o755}))
+	for _, test := range hostileArchives {
+		f.Add(makeTarGz(f, test.entries...))
+	}
+	f.Fuzz(func(t *testing.T, archive []byte) {
+		parent := t.TempDir()
+		root := filepath.Join(parent, "root")
+		_ = extractTarGz(context.Background(), bytes.NewReader(archive), root, testExtractLimits, nil)
+		checkExtracted(t, parent)
+	})
+}
+
+func FuzzExtractZip(f *testing.F) {
+	if runtime.GOOS == "windows" {
+		f.Skip("symbolic links need extra privileges on Windows")
+	}
+	f.Add(makeZip(f, testEntry{name: "ollama.exe", body: "binary"}))
+	for _, test := range hostileArchives {
+		if zipCompatible(test.entries) {
+			f.Add(makeZip(f, test.entries...))
+		}
+	}
+	f.Fuzz(func(t *testing.T, archive []byte) {
+		parent := t.TempDir()
+		root := filepath.Join(parent, "root")
+		_ = extractZip(context.Background(), bytes.NewReader(archive), root, testExtractLimits, nil)
+		checkExtracted(t, parent)
+	})
+}
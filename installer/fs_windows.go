@@ -0,0 +1,27 @@
+package main
+
+import (
+	"os"
+
+	"golang.org/x/sys/windows"
+)
+
+// Check if the file has more than one hard link.  The link count is not
+// available without opening the file on Windows, so this conservatively
+// returns true.
+func isHardLinked(info os.FileInfo) bool {
+	return true
+}
+
+// Get the number of bytes available to us on the volume containing path.
+func getFreeSpace(path string) (uint64, error) {
+	pathPtr, err := windows.UTF16PtrFromString(path)
+	if err != nil {
+		return 0, err
+	}
+	var available uint64
+	if err = windows.GetDiskFreeSpaceEx(pathPtr, &available, nil, nil); err != nil {
+		return 0, err
+	}
+	return available, nil
+}
@@ -3,6 +3,7 @@ module github.com/rancher-sandbox/rd-open-webui-docker-ext/installer
 go 1.21.1
 
 require (
+	github.com/klauspost/pgzip v1.2.6
 	github.com/xenking/zipstream v1.0.1
 	golang.org/x/sys v0.29.0
 )
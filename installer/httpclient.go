@@ -0,0 +1,225 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+const (
+	httpDialTimeout           = 30 * time.Second
+	httpTLSHandshakeTimeout   = 10 * time.Second
+	httpResponseHeaderTimeout = 30 * time.Second
+	httpIdleConnTimeout       = 90 * time.Second
+	// How long a response body may go without any data before the request is
+	// abandoned; this catches connections that stall mid-download.
+	httpBodyIdleTimeout = 60 * time.Second
+)
+
+// httpClient is used for all network requests.  There is no overall timeout,
+// as downloads may legitimately take a long time; instead each stage of the
+// request has its own timeout.
+var httpClient = &http.Client{
+	Transport: &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   httpDialTimeout,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          10,
+		IdleConnTimeout:       httpIdleConnTimeout,
+		TLSHandshakeTimeout:   httpTLSHandshakeTimeout,
+		ResponseHeaderTimeout: httpResponseHeaderTimeout,
+		ExpectContinueTimeout: time.Second,
+	},
+}
+
+// retryPolicy describes how failed requests are retried.
+type retryPolicy struct {
+	Attempts  int           // Total number of attempts, including the first.
+	BaseDelay time.Duration // Delay before the first retry; doubled each time.
+	MaxDelay  time.Duration
+	// RetryRefused is set if refused connections should be retried; for local
+	// services, a refused connection means the service is not running.
+	RetryRefused bool
+}
+
+var (
+	// Policy for requests to remote servers, such as GitHub.
+	remoteRetryPolicy = retryPolicy{Attempts: 5, BaseDelay: time.Second, MaxDelay: 30 * time.Second, RetryRefused: true}
+	// Policy for requests to remote servers that can fall back on cached data.
+	cachedRetryPolicy = retryPolicy{Attempts: 2, BaseDelay: time.Second, MaxDelay: 2 * time.Second}
+	// Policy for health checks of local services.
+	healthRetryPolicy = retryPolicy{Attempts: 3, BaseDelay: 200 * time.Millisecond, MaxDelay: time.Second}
+)
+
+// Get the delay before the given retry (starting from 1), with full jitter.
+func (p retryPolicy) delay(retry int) time.Duration {
+	delay := p.BaseDelay << (retry - 1)
+	if delay > p.MaxDelay || delay <= 0 {
+		delay = p.MaxDelay
+	}
+	return time.Duration(rand.Int63n(int64(delay))) + time.Millisecond
+}
+
+// Get the delay the server asked for in a Retry-After header, if any, limited
+// to the maximum delay so that a single response cannot stall us for long.
+func (p retryPolicy) retryAfter(resp *http.Response) (time.Duration, bool) {
+	value := resp.Header.Get("Retry-After")
+	var delay time.Duration
+	if seconds, err := strconv.Atoi(value); err == nil {
+		delay = time.Duration(seconds) * time.Second
+	} else if when, err := http.ParseTime(value); err == nil {
+		delay = time.Until(when)
+	} else {
+		return 0, false
+	}
+	if delay <= 0 {
+		return 0, false
+	}
+	return min(delay, p.MaxDelay), true
+}
+
+// Check if a request that failed with the given error or response may succeed
+// if retried.
+func (p retryPolicy) shouldRetry(resp *http.Response, err error) bool {
+	if err != nil {
+		if errors.Is(err, syscall.ECONNREFUSED) {
+			return p.RetryRefused
+		}
+		return isTransientError(err)
+	}
+	switch resp.StatusCode {
+	case http.StatusRequestTimeout, http.StatusTooManyRequests, http.StatusInternalServerError,
+		http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// Check if a request error is likely to be transient, such as a timeout or a
+// dropped connection, rather than permanent, such as an unknown host or a
+// certificate that cannot be verified.
+func isTransientError(err error) bool {
+	if errors.Is(err, context.Canceled) {
+		return false
+	}
+	var certErr *tls.CertificateVerificationError
+	var alertErr tls.AlertError
+	var recordErr tls.RecordHeaderError
+	if errors.As(err, &certErr) || errors.As(err, &alertErr) || errors.As(err, &recordErr) {
+		return false
+	}
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return dnsErr.IsTimeout || dnsErr.IsTemporary
+	}
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		// The server closed the connection.
+		return true
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+	// Other network errors, such as reset connections or unreachable networks.
+	var opErr *net.OpError
+	return errors.As(err, &opErr)
+}
+
+// Perform an idempotent (GET or HEAD) request, retrying transient failures
+// with jittered exponential backoff.  Each retry is logged.  The final
+// response is returned even if it has an error status; its body is closed if
+// it goes idle for too long.
+func doWithRetry(ctx context.Context, req *http.Request, policy retryPolicy) (*http.Response, error) {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		return nil, fmt.Errorf("cannot retry %s request for %s", req.Method, req.URL)
+	}
+	for attempt := 1; ; attempt++ {
+		attemptCtx, cancel := context.WithCancel(ctx)
+		resp, err := httpClient.Do(req.Clone(attemptCtx))
+		if attempt >= policy.Attempts || ctx.Err() != nil || !policy.shouldRetry(resp, err) {
+			if err != nil {
+				cancel()
+				return nil, err
+			}
+			resp.Body = newIdleTimeoutBody(resp.Body, httpBodyIdleTimeout, cancel)
+			return resp, nil
+		}
+
+		reason := ""
+		if err != nil {
+			reason = err.Error()
+		} else {
+			reason = resp.Status
+		}
+		delay := policy.delay(attempt)
+		if resp != nil {
+			if retryAfter, ok := policy.retryAfter(resp); ok {
+				delay = retryAfter
+			}
+			_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+			resp.Body.Close()
+		}
+		cancel()
+		log.Printf("Request for %s failed (%s); retrying in %s (attempt %d of %d)...",
+			req.URL.Redacted(), reason, delay.Round(time.Millisecond), attempt+1, policy.Attempts)
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(delay):
+		}
+	}
+}
+
+// idleTimeoutBody wraps a response body, cancelling the request if no data
+// is read for the timeout.
+type idleTimeoutBody struct {
+	body    io.ReadCloser
+	timer   *time.Timer
+	timeout time.Duration
+	cancel  context.CancelFunc
+	expired atomic.Bool
+	once    sync.Once
+}
+
+func newIdleTimeoutBody(body io.ReadCloser, timeout time.Duration, cancel context.CancelFunc) *idleTimeoutBody {
+	b := &idleTimeoutBody{body: body, timeout: timeout, cancel: cancel}
+	b.timer = time.AfterFunc(timeout, func() {
+		b.expired.Store(true)
+		cancel()
+	})
+	return b
+}
+
+func (b *idleTimeoutBody) Read(p []byte) (int, error) {
+	n, err := b.body.Read(p)
+	if n > 0 {
+		b.timer.Reset(b.timeout)
+	}
+	if err != nil && err != io.EOF && b.expired.Load() {
+		err = fmt.Errorf("no data received for %s: %w", b.timeout, err)
+	}
+	return n, err
+}
+
+func (b *idleTimeoutBody) Close() error {
+	err := b.body.Close()
+	b.once.Do(func() {
+		b.timer.Stop()
+		b.cancel()
+	})
+	return err
+}
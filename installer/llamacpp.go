@@ -0,0 +1,273 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const (
+	llamaCppReleasesURL = "https://api.github.com/repos/ggml-org/llama.cpp/releases"
+	llamaServerLogName  = "llama-server.log"
+	// The llama.cpp install directory is next to the ollama one.
+	llamaCppInstallDirName = "llama.cpp"
+	// The subdirectory of the models directory that llama-server downloads
+	// models into.
+	llamaCppCacheDirName = "llama.cpp"
+)
+
+// Limits for the llama.cpp release archives; see ollamaExtractLimits.
+var llamaCppExtractLimits = extractLimits{MaxSize: 8 << 30, MaxEntries: 10000}
+
+// llamaCppConfig configures the llama.cpp backend.
+type llamaCppConfig struct {
+	Release string `json:"release"` // A build tag such as "b6710", or "latest".
+	// Model is the model to serve: either a Hugging Face repository of GGUF
+	// files (optionally with a ":<quantization>" suffix), downloaded when the
+	// server starts, or the path of a GGUF file.
+	Model string `json:"model"`
+}
+
+// llamaCppBackend is llama.cpp's llama-server, installed from the llama.cpp
+// release archives and run by the extension.  It serves a single model, using
+// the OpenAI API rather than the ollama one, so it runs on its own port, which
+// docker-compose.yaml configures as Open WebUI's OpenAI connection.
+type llamaCppBackend struct{}
+
+// Get the directory llama.cpp is installed into.
+func getLlamaCppInstallLocation(ctx context.Context) (string, error) {
+	installLocation, err := getDefaultInstallLocation(ctx)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(filepath.Dir(installLocation), llamaCppInstallDirName), nil
+}
+
+// Find the release asset of the given llama.cpp release for this platform.
+// Depending on the release, it may be either a zip or a gzipped tar archive.
+func findLlamaCppAsset(ctx context.Context, release string) (*assetInfo, error) {
+	if isReleaseConstraint(release) || (release != releaseLatest && !strings.HasPrefix(release, "b")) {
+		return nil, fmt.Errorf("invalid llamaCpp.release %q: expected a build tag such as b6710, or %q", release, releaseLatest)
+	}
+	tag, assets, err := getReleaseAssets(ctx, llamaCppReleasesURL, release)
+	if err != nil {
+		return nil, err
+	}
+	platform := getLlamaCppAssetPlatform()
+	prefix := fmt.Sprintf("llama-%s-bin-%s.", tag, platform)
+	for _, asset := range assets {
+		if extension, ok := strings.CutPrefix(asset.Name, prefix); ok && (extension == "zip" || extension == "tar.gz") {
+			return &asset, nil
+		}
+	}
+	return nil, fmt.Errorf("failed to find a llama.cpp download for %s in release %s", platform, tag)
+}
+
+// Extract a llama.cpp release archive into the install directory.
+func extractLlamaCpp(ctx context.Context, r io.Reader, assetName, installPath string) error {
+	if strings.HasSuffix(assetName, ".zip") {
+		return extractZip(ctx, r, installPath, llamaCppExtractLimits, nil)
+	}
+	return extractTarGz(ctx, r, installPath, llamaCppExtractLimits, nil)
+}
+
+// Get the environment variables configuring llama-server; it reads its
+// arguments from LLAMA_ARG_* variables.
+func getLlamaServerSettings(ctx context.Context) (map[string]string, error) {
+	modelsDir, err := getModelsLocation(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find models directory: %w", err)
+	}
+	cacheDir := filepath.Join(modelsDir, llamaCppCacheDirName)
+	// Models may be private, so only the user should have access.
+	if err = os.MkdirAll(cacheDir, 0o700); err != nil {
+		return nil, fmt.Errorf("failed to create models directory: %w", err)
+	}
+	settings := map[string]string{
+		"LLAMA_ARG_HOST": "127.0.0.1",
+		"LLAMA_ARG_PORT": strconv.Itoa(llamaServerPort),
+		"LLAMA_CACHE":    cacheDir,
+	}
+	if strings.HasSuffix(strings.ToLower(config.LlamaCpp.Model), ".gguf") {
+		settings["LLAMA_ARG_MODEL"] = config.LlamaCpp.Model
+	} else {
+		settings["LLAMA_ARG_HF_REPO"] = config.LlamaCpp.Model
+	}
+	return settings, nil
+}
+
+func (llamaCppBackend) name() string {
+	return "llama.cpp"
+}
+
+// The executable is found by name, as the layout of the release archives
+// differs between platforms and releases.
+func (llamaCppBackend) executable(ctx context.Context) string {
+	installPath, err := getLlamaCppInstallLocation(ctx)
+	if err != nil {
+		return ""
+	}
+	var result string
+	_ = filepath.WalkDir(installPath, func(path string, entry fs.DirEntry, err error) error {
+		if err == nil && entry.Type().IsRegular() && entry.Name() == llamaServerExecutable {
+			result = path
+			return fs.SkipAll
+		}
+		return nil
+	})
+	return result
+}
+
+func (b llamaCppBackend) install(ctx context.Context) error {
+	if executablePath := b.executable(ctx); executablePath != "" {
+		version, err := validateExecutable(ctx, executablePath, parseLlamaServerVersion)
+		if err != nil {
+			return err
+		}
+		log.Printf("Found llama-server version %s at %s.", version, executablePath)
+		return nil
+	}
+
+	installPath, err := getLlamaCppInstallLocation(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get install location: %w", err)
+	}
+	asset, err := findLlamaCppAsset(ctx, config.LlamaCpp.Release)
+	if err != nil {
+		return err
+	}
+	download, err := downloadAsset(ctx, asset)
+	if err != nil {
+		return err
+	}
+	defer download.Close()
+	succeeded := false
+	defer func() {
+		if !succeeded {
+			// On failure, remove partially extracted files.
+			_ = os.RemoveAll(installPath)
+		}
+	}()
+	if err = extractLlamaCpp(ctx, download, asset.Name, installPath); err != nil {
+		return fmt.Errorf("failed to install llama.cpp: %w", err)
+	}
+	if _, err = download.finish(); err != nil {
+		return fmt.Errorf("failed to install llama.cpp: %w", err)
+	}
+
+	executablePath := b.executable(ctx)
+	if executablePath == "" {
+		return fmt.Errorf("failed to install llama.cpp: %s does not contain %s", asset.Name, llamaServerExecutable)
+	}
+	// Zip archives do not record file modes.
+	if err = os.Chmod(executablePath, 0o755); err != nil {
+		return fmt.Errorf("failed to make %s executable: %w", executablePath, err)
+	}
+	version, err := validateExecutable(ctx, executablePath, parseLlamaServerVersion)
+	if err != nil {
+		return err
+	}
+	succeeded = true
+	log.Printf("Installed llama-server version %s.", version)
+	return nil
+}
+
+func (b llamaCppBackend) start(ctx context.Context) error {
+	executablePath := b.executable(ctx)
+	if err := stopOtherOwnedServer(ctx, executablePath); err != nil {
+		return err
+	}
+	if isRunning, err := b.health(ctx); err != nil {
+		return err
+	} else if isRunning {
+		return nil
+	}
+	if executablePath == "" {
+		return fmt.Errorf("failed to find llama-server executable; was it installed?")
+	}
+	settings, err := getLlamaServerSettings(ctx)
+	if err != nil {
+		return err
+	}
+	// The server only responds successfully once the model has been
+	// downloaded and loaded.
+	log.Printf("Starting llama-server with %s...", config.LlamaCpp.Model)
+	return runServer(ctx, llamaServerLogName, executablePath, settings, getServerURL()+"/health")
+}
+
+func (b llamaCppBackend) stop(ctx context.Context) (*shutdownReport, error) {
+	if forceShutdown {
+		if executablePath := b.executable(ctx); executablePath != "" {
+			return terminateProcess(ctx, executablePath)
+		}
+		return &shutdownReport{}, nil
+	}
+	return terminateOwnedProcess(ctx)
+}
+
+func (llamaCppBackend) health(ctx context.Context) (bool, error) {
+	req, err := newServerRequest(ctx, http.MethodGet, "/health", nil)
+	if err != nil {
+		return false, fmt.Errorf("failed to check llama-server: %w", err)
+	}
+	resp, err := doWithRetry(ctx, req, healthRetryPolicy)
+	if err != nil {
+		return false, nil
+	}
+	resp.Body.Close()
+	return resp.StatusCode < 400, nil
+}
+
+func (llamaCppBackend) models(ctx context.Context) ([]string, error) {
+	var list struct {
+		Data []struct {
+			ID string `json:"id"`
+		} `json:"data"`
+	}
+	if err := getServerJSON(ctx, "/v1/models", &list); err != nil {
+		return nil, err
+	}
+	models := []string{}
+	for _, model := range list.Data {
+		models = append(models, model.ID)
+	}
+	return models, nil
+}
+
+// The version is that of the installed executable, which need not be running.
+func (b llamaCppBackend) version(ctx context.Context) (string, error) {
+	executablePath := b.executable(ctx)
+	if executablePath == "" {
+		return "", fmt.Errorf("llama-server is not installed")
+	}
+	ctx, cancel := context.WithTimeout(ctx, validateAttemptTimeout)
+	defer cancel()
+	output, err := exec.CommandContext(ctx, executablePath, "--version").CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("failed to run %s: %w", executablePath, err)
+	}
+	return parseLlamaServerVersion(string(output))
+}
+
+// Stop any processes running the installed llama-server, before it is
+// removed.
+func stopLlamaCppProcesses(ctx context.Context) error {
+	executablePath := (llamaCppBackend{}).executable(ctx)
+	if executablePath == "" {
+		return nil
+	}
+	report, err := terminateProcess(ctx, executablePath)
+	if err != nil {
+		return fmt.Errorf("error terminating existing llama-server process: %w", err)
+	}
+	report.log()
+	return nil
+}
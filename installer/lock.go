@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	lockFileName      = "installer.lock"
+	lockOwnerFileName = "installer.owner"
+	lockPollInterval  = 250 * time.Millisecond
+)
+
+// errLocked is returned by tryLockFile if another process holds the lock.
+var errLocked = errors.New("lock is held by another process")
+
+// lockOwner describes the installer process holding the lock.
+type lockOwner struct {
+	PID     int       `json:"pid"`
+	Mode    Mode      `json:"mode"`
+	Started time.Time `json:"started"`
+}
+
+// installerLock is an advisory lock held across installer processes, so that
+// operations that modify the install (or the running server) do not race.
+type installerLock struct {
+	file      *os.File
+	ownerPath string
+}
+
+// acquireLock takes the installer lock for the given mode, waiting up to the
+// timeout for any other installer operation to finish.
+func acquireLock(ctx context.Context, mode Mode, timeout time.Duration) (*installerLock, error) {
+	stateDir, err := getStateLocation(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find state directory: %w", err)
+	}
+	if err = os.MkdirAll(stateDir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create state directory: %w", err)
+	}
+	file, err := os.OpenFile(filepath.Join(stateDir, lockFileName), os.O_CREATE|os.O_RDWR, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open lock file: %w", err)
+	}
+	lock := &installerLock{file: file, ownerPath: filepath.Join(stateDir, lockOwnerFileName)}
+
+	deadline := time.Now().Add(timeout)
+	waiting := false
+	for {
+		err = tryLockFile(file)
+		if err == nil {
+			break
+		}
+		if !errors.Is(err, errLocked) {
+			file.Close()
+			return nil, fmt.Errorf("failed to lock %s: %w", file.Name(), err)
+		}
+		owner := lock.describeOwner()
+		if time.Now().After(deadline) {
+			file.Close()
+			return nil, fmt.Errorf("another installer operation %sis in progress", owner)
+		}
+		if !waiting {
+			log.Printf("Waiting for another installer operation %sto finish...", owner)
+			waiting = true
+		}
+		select {
+		case <-ctx.Done():
+			file.Close()
+			return nil, ctx.Err()
+		case <-time.After(lockPollInterval):
+		}
+	}
+
+	buf, err := json.Marshal(lockOwner{PID: os.Getpid(), Mode: mode, Started: time.Now().UTC()})
+	if err == nil {
+		err = os.WriteFile(lock.ownerPath, buf, 0o644)
+	}
+	if err != nil {
+		// The owner is informational only; holding the lock is what matters.
+		log.Printf("Failed to record lock owner: %s", err)
+	}
+
+	return lock, nil
+}
+
+// Release the lock.
+func (l *installerLock) Release() {
+	if err := os.Remove(l.ownerPath); err != nil && !errors.Is(err, os.ErrNotExist) {
+		log.Printf("Failed to remove lock owner file: %s", err)
+	}
+	if err := unlockFile(l.file); err != nil {
+		log.Printf("Failed to unlock %s: %s", l.file.Name(), err)
+	}
+	l.file.Close()
+}
+
+// Describe the current lock owner for messages, with a trailing space; returns
+// an empty string if the owner is unknown.
+func (l *installerLock) describeOwner() string {
+	owner, err := readLockOwner(l.ownerPath)
+	if err != nil || owner == nil {
+		return ""
+	}
+	return fmt.Sprintf("(pid %d, mode %s) ", owner.PID, owner.Mode)
+}
+
+// Return the installer process currently holding the lock, or nil if the lock
+// is not held.  The owner's PID may be zero if it could not be determined.
+func currentLockOwner(ctx context.Context) (*lockOwner, error) {
+	stateDir, err := getStateLocation(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find state directory: %w", err)
+	}
+	file, err := os.OpenFile(filepath.Join(stateDir, lockFileName), os.O_RDWR, 0o644)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to open lock file: %w", err)
+	}
+	defer file.Close()
+	if err = tryLockFile(file); err == nil {
+		_ = unlockFile(file)
+		return nil, nil
+	} else if !errors.Is(err, errLocked) {
+		return nil, fmt.Errorf("failed to check lock %s: %w", file.Name(), err)
+	}
+	owner, err := readLockOwner(filepath.Join(stateDir, lockOwnerFileName))
+	if err != nil || owner == nil {
+		return &lockOwner{}, nil
+	}
+	return owner, nil
+}
+
+// Read the lock owner file; returns nil if there is none.  Note that the file
+// is only meaningful while the lock is held.
+func readLockOwner(ownerPath string) (*lockOwner, error) {
+	buf, err := os.ReadFile(ownerPath)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var owner lockOwner
+	if err = json.Unmarshal(buf, &owner); err != nil {
+		return nil, err
+	}
+	return &owner, nil
+}
@@ -4,284 +4,628 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
-	"io"
 	"log"
 	"net/http"
 	"os"
 	"os/exec"
+	"os/signal"
 	"path/filepath"
 	"slices"
+	"strings"
+	"syscall"
 	"time"
 )
 
 const (
-	checkURL = "http://localhost:11434/api/tags"
+	serverLogName     = "ollama.log"
+	serverPIDFileName = "ollama.pid"
+	maxLogSize        = 10 * 1024 * 1024
 )
 
 type Mode string
 
 const (
-	ModeInstall   Mode = "install"   // Install ollama to the default location.
-	ModeUninstall Mode = "uninstall" // Uninstall ollama that we have installed.
-	ModeCheck     Mode = "check"     // Check if Ollama is installed, printing "true" or "false".
-	ModeStart     Mode = "start"     // Run ollama in a new process and return immediately.
-	ModeShutdown  Mode = "shutdown"  // Terminate any running ollama instrances.
+	ModeInstall      Mode = "install"       // Install ollama to the default location.
+	ModeUninstall    Mode = "uninstall"     // Uninstall ollama that we have installed.
+	ModeCheck        Mode = "check"         // Check if Ollama is installed, printing "true" or "false".
+	ModeStart        Mode = "start"         // Run ollama in a new process and return immediately.
+	ModeShutdown     Mode = "shutdown"      // Terminate any running ollama instrances.
+	ModeCancel       Mode = "cancel"        // Cancel an in-progress install, start, or model pull.
+	ModePull         Mode = "pull"          // Pull the model, recording progress for ModePullStatus.
+	ModePullStatus   Mode = "pull-status"   // Print the status of the background model pull as JSON.
+	ModeConfig       Mode = "config"        // Print the effective configuration and where each value came from.
+	ModeApply        Mode = "apply"         // Restart the ollama server if its settings have changed.
+	ModeStatus       Mode = "status"        // Print the install and server status as JSON.
+	ModeModelsDetect Mode = "models-detect" // List models directories of external ollama installs as JSON.
+	ModeModelsImport Mode = "models-import" // Import models from an external ollama install.
+	ModeModelsShare  Mode = "models-share"  // Use the models directory of an external ollama install.
+	ModePreflight    Mode = "preflight"     // Check whether ollama can be installed, printing findings as JSON.
+	ModeDiagnose     Mode = "diagnose"      // Collect diagnostic information into a tar.gz file.
+	ModeVerify       Mode = "verify"        // Check the installed files against the install receipt.
+	ModeRepair       Mode = "repair"        // Restore damaged installed files.
+	ModeReleases     Mode = "releases"      // List the releases available for this machine as JSON.
+	ModeUpdateCheck  Mode = "update-check"  // Check if a newer release is available, printing the result as JSON.
+	ModeProxy        Mode = "proxy"         // Serve the remote server on the ollama port until stopped.
 )
 
 var (
-	mode           = ModeInstall
-	allModes       = []Mode{ModeInstall, ModeUninstall, ModeCheck, ModeStart, ModeShutdown}
-	releaseVersion = flag.String("release", "latest", "release to download when installing")
-	pullModel      = flag.String("model", "tinyllama", "model to pull on install; set to empty string to skip")
+	mode          = ModeInstall
+	mutatingModes = []Mode{ModeInstall, ModeUninstall, ModeStart, ModeShutdown, ModeApply, ModeModelsImport, ModeModelsShare, ModeRepair} // Modes that must hold the installer lock.
+	forceShutdown bool
+	gracePeriod   time.Duration
+	lockTimeout   time.Duration
 )
 
+// Register the flag controlling how long to wait for the installer lock.
+func lockFlags(flags *flag.FlagSet) {
+	flags.DurationVar(&lockTimeout, "lock-timeout", 5*time.Minute, "time to wait for another installer operation to finish")
+}
+
+// Register the flags controlling how ollama is stopped.
+func stopFlags(flags *flag.FlagSet) {
+	flags.DurationVar(&gracePeriod, "grace-period", 10*time.Second, "time to wait for ollama to exit before killing it")
+}
+
+// Register the flags used when shutting down.
+func shutdownFlags(flags *flag.FlagSet) {
+	flags.BoolVar(&forceShutdown, "force", false, "when shutting down, stop all processes running the managed ollama, not just the one we started")
+}
+
 func main() {
-	ctx := context.Background()
+	// Cancelling the context lets in-progress downloads clean up after
+	// themselves; see ModeCancel.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	watchCancelRequests(ctx, cancel)
 	log.SetFlags(log.LUTC | log.Ldate | log.Ltime)
-	flag.Func("mode", fmt.Sprintf("operation mode; one of %+v (default %q)", allModes, mode), func(s string) error {
-		if i := slices.Index(allModes, Mode(s)); i > -1 {
-			mode = allModes[i]
-		} else {
-			return fmt.Errorf("unexpected mode %s: should be one of %+v", s, allModes)
+	flags := parseCommandLine(os.Args[1:])
+
+	if cfg, err := loadConfig(ctx, flags); err != nil {
+		log.Fatalf("Failed to load configuration: %s", err)
+	} else {
+		config = cfg
+	}
+	if config.Proxy != "" {
+		// Set the proxy in the environment so that it is used both for our own
+		// requests and by the ollama server.
+		for _, name := range []string{"HTTPS_PROXY", "HTTP_PROXY"} {
+			if err := os.Setenv(name, config.Proxy); err != nil {
+				log.Fatalf("Failed to set proxy: %s", err)
+			}
 		}
-		return nil
-	})
-	flag.Parse()
+	}
 
+	var err error
+	if slices.Contains(mutatingModes, mode) {
+		var lock *installerLock
+		if lock, err = acquireLock(ctx, mode, lockTimeout); err == nil {
+			err = run(ctx)
+			lock.Release()
+		}
+	} else {
+		err = run(ctx)
+	}
+	if err != nil {
+		if errors.Is(err, context.Canceled) {
+			log.Printf("Operation %s was cancelled.", mode)
+		}
+		// Calling log.Fatal skips deferred calls, so do them explicitly.
+		cancel()
+		stop()
+		log.Fatal(err)
+	}
+}
+
+// Run the selected mode.
+func run(ctx context.Context) error {
 	switch mode {
 	case ModeInstall:
-		log.Printf("Installing ollama...")
-		if err := install(ctx); err != nil {
-			log.Fatal(err)
-		}
+		b := getBackend()
+		log.Printf("Installing %s...", b.name())
+		return b.install(ctx)
 	case ModeUninstall:
 		log.Printf("Uninstalling ollama...")
-		if err := uninstallOllama(ctx); err != nil {
-			log.Fatal(err)
-		}
+		return uninstall(ctx)
 	case ModeCheck:
-		if err := checkInstall(ctx); err != nil {
-			log.Fatal(err)
-		}
+		return checkInstall(ctx, getBackend())
 	case ModeStart:
-		if err := startOllama(ctx); err != nil {
-			log.Fatal(err)
-		}
+		return getBackend().start(ctx)
 	case ModeShutdown:
-		if err := shutdownOllama(ctx); err != nil {
-			log.Fatal(err)
-		}
+		return shutdownServer(ctx, getBackend())
+	case ModeCancel:
+		return cancelOperation(ctx)
+	case ModePull:
+		return pullModelsWithStatus(ctx, config.Models)
+	case ModePullStatus:
+		return printPullStatus(ctx)
+	case ModeConfig:
+		return printConfig(ctx)
+	case ModeApply:
+		return applyServerSettings(ctx)
+	case ModeStatus:
+		return printStatus(ctx)
+	case ModeModelsDetect:
+		return printExternalModels(ctx)
+	case ModeModelsImport:
+		return importModels(ctx)
+	case ModeModelsShare:
+		return shareModels(ctx)
+	case ModePreflight:
+		return printPreflight(ctx)
+	case ModeDiagnose:
+		return diagnose(ctx)
+	case ModeVerify:
+		return verifyInstall(ctx)
+	case ModeRepair:
+		return repairInstall(ctx)
+	case ModeReleases:
+		return printReleases(ctx)
+	case ModeUpdateCheck:
+		return printUpdateCheck(ctx)
+	case ModeProxy:
+		return serveRemoteProxy(ctx)
+	}
+	return fmt.Errorf("unexpected mode %s", mode)
+}
+
+// The ports used by the extension.  The ollama port may be changed with
+// ports.ollama, though Open WebUI must then be pointed at it.  Open WebUI and
+// SearXNG are published on fixed ports by docker-compose.yaml, and Open WebUI
+// connects to llama-server's OpenAI API on a fixed port, so the others cannot
+// be configured.
+const (
+	defaultOllamaPort = 11434
+	llamaServerPort   = 11435
+	openWebUIPort     = 11500
+	searxngPort       = 11505
+)
+
+// Get the base URL of the server; this is the ollama port unless the remote or
+// llama.cpp backend is used.
+func getServerURL() string {
+	switch config.Backend {
+	case backendRemote:
+		return strings.TrimSuffix(config.Remote.URL, "/")
+	case backendLlamaCpp:
+		return fmt.Sprintf("http://localhost:%d", llamaServerPort)
 	}
+	return getLocalServerURL()
+}
+
+// Get the base URL of the ollama port, which Open WebUI connects to; with the
+// remote backend, this is served by the remote proxy.
+func getLocalServerURL() string {
+	return fmt.Sprintf("http://localhost:%d", config.Ports.Ollama)
 }
 
 // Check if Ollama is already running.
 func checkExistingInstance(ctx context.Context) (bool, error) {
-	log.Printf("Checking if %s returns a valid response...", checkURL)
-	req, err := http.NewRequestWithContext(ctx, http.MethodGet, checkURL, nil)
+	log.Printf("Checking if %s/api/tags returns a valid response...", getServerDisplayURL())
+	req, err := newServerRequest(ctx, http.MethodGet, "/api/tags", nil)
 	if err != nil {
 		return false, fmt.Errorf("failed to check Ollama: %v", err)
 	}
-	resp, err := http.DefaultClient.Do(req)
-	if err == nil && resp.StatusCode < 400 {
-		defer resp.Body.Close()
+	resp, err := doWithRetry(ctx, req, healthRetryPolicy)
+	if err != nil {
+		return false, nil
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 400 {
 		log.Printf("Ollama seems to be running correctly.")
 		return true, nil
 	}
 	return false, nil
 }
 
-func install(ctx context.Context) error {
-	isRunning, err := checkExistingInstance(ctx)
-	if err != nil {
-		return err
-	}
-	if isRunning {
-		return nil
-	}
-	executablePath := findExecutable(ctx, false)
-	if executablePath == "" {
-		// If a previous executable is not found, install it to the default
-		// location.
-		installLocation, err := getDefaultInstallLocation(ctx)
-		if err != nil {
-			return fmt.Errorf("failed to get install location: %w", err)
-		}
-		_, err = installOllama(ctx, *releaseVersion, installLocation)
-		if err != nil {
-			return fmt.Errorf("failed to install ollama: %w", err)
-		}
-	}
-
-	// To ensure the file has been completely written (and virus scanners are done
-	// scanning), try to run it a few times.
-	for i := 0; i < 10; i++ {
-		if err = exec.Command(executablePath, "--version").Run(); err == nil {
-			break
-		}
-		time.Sleep(time.Second)
-	}
-
-	return nil
-}
-
 type releaseInfo struct {
+	TagName   string `json:"tag_name"`
 	AssetsURL string `json:"assets_url"`
 }
 
 type assetInfo struct {
 	Name string `json:"name"`
 	URL  string `json:"browser_download_url"`
+	Size int64  `json:"size"`
+	// Digest is the "sha256:<hex>" digest of the asset, if GitHub has one.
+	Digest string `json:"digest"`
+	// Release is the tag of the release the asset belongs to.
+	Release string `json:"-"`
 }
 
-// getReleaseAssetURL returns the download URL for a specific asset in a release.
-func getReleaseAssetURL(ctx context.Context, release, assetName string) (string, error) {
-	releaseURL := fmt.Sprintf("https://api.github.com/repos/ollama/ollama/releases/tags/%s", release)
-	if release == "latest" {
-		releaseURL = "https://api.github.com/repos/ollama/ollama/releases/latest"
+// getReleaseAsset returns information about a specific asset in a release.
+func getReleaseAsset(ctx context.Context, release, assetName string) (*assetInfo, error) {
+	if isReleaseConstraint(release) {
+		return findConstrainedReleaseAsset(ctx, release, assetName)
 	}
-	releaseReq, err := http.NewRequestWithContext(ctx, http.MethodGet, releaseURL, nil)
+	_, assets, err := getReleaseAssets(ctx, ollamaReleasesURL, release)
 	if err != nil {
-		return "", fmt.Errorf("failed to find release: %w", err)
+		return nil, err
 	}
-	releaseResp, err := http.DefaultClient.Do(releaseReq)
-	if err != nil {
-		return "", fmt.Errorf("failed to find release: %w", err)
+	for _, asset := range assets {
+		if asset.Name == assetName {
+			return &asset, nil
+		}
 	}
-	defer releaseResp.Body.Close()
-	if releaseResp.StatusCode >= 300 {
-		return "", fmt.Errorf("failed to find release: unexpected status %s", releaseResp.Status)
+	return nil, fmt.Errorf("failed to find asset %q in release %q", assetName, release)
+}
+
+// Get the tag and assets of a release (given by tag, or "latest") from the
+// GitHub releases API at releasesURL.
+func getReleaseAssets(ctx context.Context, releasesURL, release string) (string, []assetInfo, error) {
+	releaseURL := fmt.Sprintf("%s/tags/%s", releasesURL, release)
+	if release == releaseLatest {
+		releaseURL = releasesURL + "/latest"
 	}
-	releaseBody, err := io.ReadAll(releaseResp.Body)
+	releaseEntry, err := fetchMetadata(ctx, releaseURL)
 	if err != nil {
-		return "", fmt.Errorf("failed to find release: reading response: %w", err)
+		return "", nil, fmt.Errorf("failed to find release: %w", err)
 	}
 	var releaseInfo releaseInfo
-	if err = json.Unmarshal(releaseBody, &releaseInfo); err != nil {
-		return "", fmt.Errorf("failed to find release: error unmarshaling response: %w", err)
+	if err = json.Unmarshal(releaseEntry.Body, &releaseInfo); err != nil {
+		return "", nil, fmt.Errorf("failed to find release: error unmarshaling response: %w", err)
 	}
 
-	assetsReq, err := http.NewRequestWithContext(ctx, http.MethodGet, releaseInfo.AssetsURL, nil)
-	if err != nil {
-		return "", fmt.Errorf("failed to find assets: %w", err)
-	}
-	assetsResp, err := http.DefaultClient.Do(assetsReq)
+	assetsEntry, err := fetchMetadata(ctx, releaseInfo.AssetsURL)
 	if err != nil {
-		return "", fmt.Errorf("failed to find assets: %w", err)
-	}
-	defer assetsResp.Body.Close()
-	if assetsResp.StatusCode >= 300 {
-		return "", fmt.Errorf("failed to find assets: unexpected status %s", assetsResp.Status)
-	}
-	assetsBody, err := io.ReadAll(assetsResp.Body)
-	if err != nil {
-		return "", fmt.Errorf("failed to find assets: reading response: %w", err)
+		return "", nil, fmt.Errorf("failed to find assets: %w", err)
 	}
 	var assets []assetInfo
-	if err = json.Unmarshal(assetsBody, &assets); err != nil {
-		return "", fmt.Errorf("failed to find assets: error unmarshaling response: %w", err)
+	if err = json.Unmarshal(assetsEntry.Body, &assets); err != nil {
+		return "", nil, fmt.Errorf("failed to find assets: error unmarshaling response: %w", err)
 	}
 
-	for _, asset := range assets {
-		if asset.Name == assetName {
-			return asset.URL, nil
-		}
+	if release == releaseLatest {
+		log.Printf("Resolved release %q to %s.", release, releaseInfo.TagName)
+	}
+	for i := range assets {
+		assets[i].Release = releaseInfo.TagName
 	}
+	return releaseInfo.TagName, assets, nil
+}
 
-	return "", fmt.Errorf("failed to find asset %q in release %q", assetName, release)
+// Get the directory the extension is installed into; the installer executable
+// lives in a subdirectory of it.
+func getExtensionDir() (string, error) {
+	executable, err := os.Executable()
+	if err != nil {
+		return "", fmt.Errorf("failed to find executable path: %w", err)
+	}
+	return filepath.Dir(filepath.Dir(executable)), nil
 }
 
 // Get the default install location.  Note that this does not return the
 // location of any externally installed copies of ollama.
 func getDefaultInstallLocation(ctx context.Context) (string, error) {
-	executable, err := os.Executable()
+	if config.Paths.Install != "" {
+		return config.Paths.Install, nil
+	}
+	extensionDir, err := getExtensionDir()
 	if err != nil {
-		return "", fmt.Errorf("failed to find executable path: %w", err)
+		return "", err
 	}
-	extensionDir := filepath.Dir(filepath.Dir(executable))
 	return filepath.Join(extensionDir, "ollama"), nil
 }
 
-// Print "true" if Ollama is installed, or "false" otherwise.
-func checkInstall(ctx context.Context) error {
-	isRunning, err := checkExistingInstance(ctx)
-	if err == nil && isRunning {
-		if _, err = fmt.Println("true"); err != nil {
-			return fmt.Errorf("failed to output state")
-		}
-		return nil
+// Get the default location of the given per-user data directory, such as
+// "models".  Data is kept outside the extension directory, as that is deleted
+// whenever the extension is uninstalled or upgraded.
+func getDefaultDataLocation(name string) (string, error) {
+	dataDir, err := getUserDataDir()
+	if err != nil {
+		return "", fmt.Errorf("failed to find user data directory: %w", err)
 	}
-	location := findExecutable(ctx, false)
-	if location != "" {
-		if _, err := os.Stat(location); err == nil {
-			if _, err = fmt.Println("true"); err != nil {
-				return fmt.Errorf("failed to output location: %w", err)
-			}
-			return nil
-		}
+	return filepath.Join(dataDir, configDirName, name), nil
+}
+
+// Get the default location for downloaded caches.
+func getDefaultCacheLocation() (string, error) {
+	cacheDir, err := os.UserCacheDir()
+	if err != nil {
+		return "", fmt.Errorf("failed to find user cache directory: %w", err)
+	}
+	return filepath.Join(cacheDir, configDirName, "cache"), nil
+}
+
+// Get the directory used for runtime state, such as PID files.
+func getStateLocation(ctx context.Context) (string, error) {
+	if config.Paths.State != "" {
+		return config.Paths.State, nil
+	}
+	return getDefaultDataLocation("state")
+}
+
+// Get the directory the managed ollama server stores models in.
+func getModelsLocation(ctx context.Context) (string, error) {
+	if config.Paths.Models != "" {
+		return config.Paths.Models, nil
+	}
+	return getDefaultDataLocation("models")
+}
+
+// Get the directory used for downloaded caches.
+func getCacheLocation(ctx context.Context) (string, error) {
+	if config.Paths.Cache != "" {
+		return config.Paths.Cache, nil
+	}
+	return getDefaultCacheLocation()
+}
+
+// Get the directory that log files are written to.
+func getLogLocation(ctx context.Context) (string, error) {
+	if config.Paths.Logs != "" {
+		return config.Paths.Logs, nil
+	}
+	return getDefaultDataLocation("logs")
+}
+
+// Print "true" if the backend is installed or its server is running, or
+// "false" otherwise.  With the remote backend, this reports whether the remote
+// server can be used.
+func checkInstall(ctx context.Context, b backend) error {
+	if _, err := fmt.Println(isBackendInstalled(ctx, b)); err != nil {
+		return fmt.Errorf("failed to output state: %w", err)
 	}
-	fmt.Println("false")
 	return nil
 }
 
-func startOllama(ctx context.Context) error {
-	isRunning, err := checkExistingInstance(ctx)
+// Check if the backend is installed or its server is running.
+func isBackendInstalled(ctx context.Context, b backend) bool {
+	isRunning, err := b.health(ctx)
+	return (err == nil && isRunning) || b.executable(ctx) != ""
+}
+
+// Start the ollama server with the configured settings, and wait for it to
+// respond.
+func startServer(ctx context.Context, executablePath string) error {
+	modelsDir, err := getModelsLocation(ctx)
 	if err != nil {
-		return err
+		return fmt.Errorf("failed to find models directory: %w", err)
 	}
-	if isRunning {
-		return nil
+	// Models may be private, so only the user should have access.
+	if err = os.MkdirAll(modelsDir, 0o700); err != nil {
+		return fmt.Errorf("failed to create models directory: %w", err)
 	}
+	return runServer(ctx, serverLogName, executablePath, getServerSettings(modelsDir), getServerURL()+"/api/tags", "serve")
+}
 
-	executablePath := findExecutable(ctx, false)
-	if executablePath == "" {
-		return fmt.Errorf("failed to find ollama executable; was it installed?")
+// Stop the server started by the extension if it runs a different executable,
+// such as the server of another backend; only one server is recorded in the PID
+// file, and the one started next would replace it.
+func stopOtherOwnedServer(ctx context.Context, executablePath string) error {
+	pidFile, err := readPIDFile(ctx)
+	if err != nil || pidFile == nil || !isOwnedServerRunning(pidFile) || pidFile.Executable == executablePath {
+		return err
 	}
+	log.Printf("Stopping %s, previously started by the extension...", pidFile.Executable)
+	report, err := terminateOwnedProcess(ctx)
+	if err != nil {
+		return err
+	}
+	report.log()
+	removePIDFile(ctx)
+	return nil
+}
 
-	// Do not wait for serveProc to complete.
-	serveProc := exec.Command(executablePath, "serve")
-	serveProc.Stdout = os.Stdout
-	serveProc.Stderr = os.Stderr
-	if err = serveProc.Start(); err != nil {
-		return fmt.Errorf("failed to start ollama server: %v", err)
+// Start a server process with the given settings added to its environment,
+// record it in the PID file, and wait for healthURL to respond successfully.
+func runServer(ctx context.Context, logName, executablePath string, settings map[string]string, healthURL string, args ...string) error {
+	name := filepath.Base(executablePath)
+	pid, err := startDetachedProcess(ctx, logName, serverEnvironment(settings), executablePath, args...)
+	if err != nil {
+		return fmt.Errorf("failed to start %s server: %w", name, err)
+	}
+	if err = writePIDFile(ctx, pid, executablePath, settings); err != nil {
+		return err
 	}
 
-	log.Printf("Waiting for %s to succeed...", checkURL)
+	log.Printf("Waiting for %s to succeed...", healthURL)
 	for {
-		req, err := http.NewRequestWithContext(ctx, http.MethodGet, checkURL, nil)
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, healthURL, nil)
 		if err != nil {
-			return fmt.Errorf("failed to check Ollama: %v", err)
+			return fmt.Errorf("failed to check %s: %v", name, err)
 		}
-		resp, err := http.DefaultClient.Do(req)
-		if err == nil && resp.StatusCode < 400 {
+		// This is already polling, so there is no need to retry.
+		resp, err := httpClient.Do(req)
+		if err == nil {
 			resp.Body.Close()
-			break
+			if resp.StatusCode < 400 {
+				return nil
+			}
+		}
+		if !isProcessRunning(pid) {
+			return fmt.Errorf("%s server exited before responding; see %s in the logs directory", name, logName)
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("failed waiting for %s server: %w", name, ctx.Err())
+		case <-time.After(time.Second):
 		}
-		time.Sleep(time.Second)
 	}
+}
 
-	if *pullModel != "" {
-		pullProc := exec.CommandContext(ctx, executablePath, "pull", *pullModel)
-		pullProc.Stdout = os.Stdout
-		pullProc.Stderr = os.Stderr
-		if err = pullProc.Run(); err != nil {
-			return fmt.Errorf("failed to pull %s: %v", *pullModel, err)
+// Cancel the installer operation currently holding the lock, if any, and wait
+// for it to finish.  Prints a JSON description of what was cancelled.
+func cancelOperation(ctx context.Context) error {
+	owner, err := currentLockOwner(ctx)
+	if err != nil {
+		return err
+	}
+	result := struct {
+		Cancelled bool `json:"cancelled"`
+		PID       int  `json:"pid,omitempty"`
+		Mode      Mode `json:"mode,omitempty"`
+	}{}
+	if pid, err := cancelPullJob(ctx); err != nil {
+		log.Printf("Failed to cancel model pull: %s", err)
+	} else if pid != 0 {
+		result.Cancelled, result.PID, result.Mode = true, pid, ModePull
+	}
+	if owner != nil {
+		if owner.PID == 0 {
+			return fmt.Errorf("an installer operation is in progress, but its process is unknown")
+		}
+		log.Printf("Cancelling installer operation %s (pid %d)...", owner.Mode, owner.PID)
+		if err = requestCancel(owner.PID); err != nil {
+			return fmt.Errorf("failed to cancel pid %d: %w", owner.PID, err)
+		}
+		// Wait for the operation to clean up and release the lock.
+		lock, err := acquireLock(ctx, ModeCancel, lockTimeout)
+		if err != nil {
+			return err
 		}
+		lock.Release()
+		result.Cancelled, result.PID, result.Mode = true, owner.PID, owner.Mode
 	}
+	if err = json.NewEncoder(os.Stdout).Encode(result); err != nil {
+		return fmt.Errorf("failed to output result: %w", err)
+	}
+	return nil
+}
 
+// Open the named log file, rotating out the previous log if it has grown too
+// large.
+func openLog(ctx context.Context, name string) (*os.File, error) {
+	logDir, err := getLogLocation(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find log directory: %w", err)
+	}
+	if err = os.MkdirAll(logDir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create log directory: %w", err)
+	}
+	logPath := filepath.Join(logDir, name)
+	if info, err := os.Stat(logPath); err == nil && info.Size() > maxLogSize {
+		if err = os.Rename(logPath, logPath+".1"); err != nil {
+			log.Printf("Failed to rotate %s: %s", logPath, err)
+		}
+	}
+	logFile, err := os.OpenFile(logPath, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open log file: %w", err)
+	}
+	return logFile, nil
+}
+
+// Start a process that outlives this one, with its output going to the named
+// log file; returns its PID.  If env is nil, the process inherits our
+// environment.  The process must not be tied to our standard
+// streams (which belong to the caller) or our process group.
+func startDetachedProcess(ctx context.Context, logName string, env []string, executablePath string, args ...string) (int, error) {
+	devNull, err := os.Open(os.DevNull)
+	if err != nil {
+		return 0, fmt.Errorf("failed to open %s: %w", os.DevNull, err)
+	}
+	defer devNull.Close()
+	logFile, err := openLog(ctx, logName)
+	if err != nil {
+		return 0, err
+	}
+	defer logFile.Close()
+
+	// Do not wait for the process to complete.
+	proc := exec.Command(executablePath, args...)
+	proc.Env = env
+	proc.Stdin = devNull
+	proc.Stdout = logFile
+	proc.Stderr = logFile
+	detachProcess(proc)
+	if err = proc.Start(); err != nil {
+		return 0, err
+	}
+	pid := proc.Process.Pid
+	log.Printf("Started %s (pid %d), logging to %s", filepath.Base(executablePath), pid, logFile.Name())
+	if err = proc.Process.Release(); err != nil {
+		return 0, fmt.Errorf("failed to release process %d: %w", pid, err)
+	}
+	return pid, nil
+}
+
+// serverPIDFile is the content of the PID file for the ollama server we started.
+// The start time is recorded to detect PID reuse; its unit is platform-specific.
+type serverPIDFile struct {
+	PID        int               `json:"pid"`
+	StartTime  uint64            `json:"startTime"`
+	Executable string            `json:"executable"`
+	Settings   map[string]string `json:"settings"` // Environment the server was started with.
+}
+
+// Record the PID of the ollama server we started.
+func writePIDFile(ctx context.Context, pid int, executablePath string, settings map[string]string) error {
+	stateDir, err := getStateLocation(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to find state directory: %w", err)
+	}
+	if err = os.MkdirAll(stateDir, 0o755); err != nil {
+		return fmt.Errorf("failed to create state directory: %w", err)
+	}
+	startTime, err := getProcessStartTime(pid)
+	if err != nil {
+		return fmt.Errorf("failed to get start time of pid %d: %w", pid, err)
+	}
+	buf, err := json.Marshal(serverPIDFile{PID: pid, StartTime: startTime, Executable: executablePath, Settings: settings})
+	if err != nil {
+		return fmt.Errorf("failed to serialize PID file: %w", err)
+	}
+	pidPath := filepath.Join(stateDir, serverPIDFileName)
+	if err = os.WriteFile(pidPath, buf, 0o644); err != nil {
+		return fmt.Errorf("failed to write PID file: %w", err)
+	}
 	return nil
 }
 
-func shutdownOllama(ctx context.Context) error {
-	executablePath := findExecutable(ctx, true)
-	if executablePath == "" {
-		// When shutting down, it is not an error if it was not found.
-		return nil
+// Read the PID file for the ollama server we started; returns nil if there is
+// no PID file.
+func readPIDFile(ctx context.Context) (*serverPIDFile, error) {
+	stateDir, err := getStateLocation(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find state directory: %w", err)
+	}
+	buf, err := os.ReadFile(filepath.Join(stateDir, serverPIDFileName))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to read PID file: %w", err)
+	}
+	var pidFile serverPIDFile
+	if err = json.Unmarshal(buf, &pidFile); err != nil {
+		return nil, fmt.Errorf("failed to parse PID file: %w", err)
+	}
+	return &pidFile, nil
+}
+
+// Remove the PID file for the ollama server.
+func removePIDFile(ctx context.Context) {
+	if stateDir, err := getStateLocation(ctx); err == nil {
+		err = os.Remove(filepath.Join(stateDir, serverPIDFileName))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			log.Printf("Failed to remove PID file: %s", err)
+		}
+	}
+}
+
+// Stop the server, printing a JSON report of the processes stopped.  Unless
+// forced, only the server started by this extension is stopped.
+func shutdownServer(ctx context.Context, b backend) error {
+	// A model pull cannot succeed without the server; stop it first.
+	if _, err := cancelPullJob(ctx); err != nil {
+		log.Printf("Failed to cancel model pull: %s", err)
 	}
-	err := terminateProcess(ctx, executablePath)
+	report, err := b.stop(ctx)
 	if err != nil {
 		return err
 	}
+	report.log()
+	removePIDFile(ctx)
+	if report.Processes == nil {
+		report.Processes = []stoppedProcess{}
+	}
+	if err = json.NewEncoder(os.Stdout).Encode(report); err != nil {
+		return fmt.Errorf("failed to output shutdown report: %w", err)
+	}
 	return nil
 }
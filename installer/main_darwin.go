@@ -6,10 +6,13 @@ import (
 	"fmt"
 	"io"
 	"log"
-	"net/http"
 	"os"
+	"os/exec"
 	"path/filepath"
+	"runtime"
 	"slices"
+	"strconv"
+	"strings"
 
 	"golang.org/x/sys/unix"
 )
@@ -17,6 +20,7 @@ import (
 const (
 	CTL_KERN      = "kern"
 	KERN_PROCARGS = 38
+	SZOMB         = 5 // Process state for zombies, from <sys/proc.h>
 )
 
 // Find an existing install of ollama; if defaultOnly is false, this may include
@@ -49,63 +53,140 @@ func findExecutable(ctx context.Context, defaultOnly bool) string {
 	return ""
 }
 
-func installOllama(ctx context.Context, release, executablePath string) (string, error) {
-	if _, err := os.Stat(executablePath); err == nil {
-		return executablePath, nil
-	} else if !errors.Is(err, os.ErrNotExist) {
-		return "", fmt.Errorf("failed to check ollama executable: %w", err)
+// Get the base directory for per-user data: ~/Library/Application Support.
+func getUserDataDir() (string, error) {
+	return os.UserConfigDir()
+}
+
+// Run the process in its own session, so that it is not affected by signals
+// sent to our process group.
+func detachProcess(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &unix.SysProcAttr{Setsid: true}
+}
+
+// The release asset is the executable itself.
+const ollamaAssetExpansion = 1
+
+// Get the name of the release asset containing ollama for this platform.
+func getOllamaAssetName() string {
+	return "ollama-darwin"
+}
+
+// The name of the llama.cpp server executable.
+const llamaServerExecutable = "llama-server"
+
+// Get the platform in the name of the llama.cpp release asset for this
+// platform, e.g. "macos-arm64" in "llama-b6710-bin-macos-arm64.zip".
+func getLlamaCppAssetPlatform() string {
+	if runtime.GOARCH == "amd64" {
+		return "macos-x64"
+	}
+	return "macos-arm64"
+}
+
+// Check for macOS specific problems: the install directory being on a noexec
+// mount.
+func platformPreflightChecks(ctx context.Context, dir string) []preflightFinding {
+	var stat unix.Statfs_t
+	if err := unix.Statfs(dir, &stat); err != nil {
+		return []preflightFinding{{Check: "noexec", Severity: preflightWarning,
+			Message: fmt.Sprintf("failed to check mount options of %s: %s", dir, err)}}
 	}
+	if stat.Flags&unix.MNT_NOEXEC != 0 {
+		return []preflightFinding{{Check: "noexec", Severity: preflightBlocking,
+			Message: fmt.Sprintf("%s is on a file system mounted noexec", dir)}}
+	}
+	return nil
+}
 
-	assetURL, err := getReleaseAssetURL(ctx, release, "ollama-darwin")
+// Get the total physical memory, in bytes.
+func getTotalMemory() (uint64, error) {
+	return unix.SysctlUint64("hw.memsize")
+}
+
+// Find the process listening on the given TCP port, using lsof; returns zero
+// if there is none.
+func findPortOwner(ctx context.Context, port int) (int, error) {
+	output, err := exec.CommandContext(ctx, "lsof", "-nP", fmt.Sprintf("-iTCP:%d", port), "-sTCP:LISTEN", "-t").Output()
 	if err != nil {
-		return "", err
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) && len(output) == 0 {
+			// lsof exits with an error if nothing matched.
+			return 0, nil
+		}
+		return 0, fmt.Errorf("failed to run lsof: %w", err)
 	}
+	fields := strings.Fields(string(output))
+	if len(fields) == 0 {
+		return 0, nil
+	}
+	return strconv.Atoi(fields[0])
+}
 
-	log.Printf("Downloading ollama from %s...", assetURL)
+func installOllama(ctx context.Context, release, executablePath string) (string, *assetInfo, error) {
+	if _, err := os.Stat(executablePath); err == nil {
+		return executablePath, nil, nil
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return "", nil, fmt.Errorf("failed to check ollama executable: %w", err)
+	}
 
-	// For darwin, Ollama is a single executable.
-	if err = os.MkdirAll(filepath.Dir(executablePath), 0o755); err != nil {
-		return "", fmt.Errorf("failed to create ollama directory: %w", err)
+	asset, err := getReleaseAsset(ctx, release, getOllamaAssetName())
+	if err != nil {
+		return "", nil, err
 	}
-	file, err := os.OpenFile(executablePath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o755)
+	download, err := downloadAsset(ctx, asset)
 	if err != nil {
-		return "", fmt.Errorf("failed to create executable: %w", err)
+		return "", nil, err
 	}
-	defer file.Close()
+	defer download.Close()
+
 	succeeded := false
 	defer func() {
 		if !succeeded {
 			os.Remove(executablePath)
 		}
 	}()
+	if err = extractOllama(ctx, download, executablePath, nil); err != nil {
+		return "", nil, err
+	}
+	if asset.Digest, err = download.finish(); err != nil {
+		return "", nil, err
+	}
+	succeeded = true
 
-	req, err := http.NewRequestWithContext(ctx, http.MethodGet, assetURL, nil)
-	if err != nil {
-		return "", fmt.Errorf("failed to create request: %w", err)
+	return executablePath, asset, nil
+}
+
+// Write the ollama release asset to the executable path.  The asset is a
+// single file, so include is only consulted for the executable itself (with
+// the name ".").
+func extractOllama(ctx context.Context, r io.Reader, executablePath string, include func(name string) bool) error {
+	if include != nil && !include(".") {
+		return nil
 	}
-	resp, err := http.DefaultClient.Do(req)
-	if err != nil {
-		return "", fmt.Errorf("failed to download ollama: %w", err)
+	// For darwin, Ollama is a single executable.  Write it to a temporary file
+	// first, so that a running copy is replaced rather than modified.
+	if err := os.MkdirAll(filepath.Dir(executablePath), 0o755); err != nil {
+		return fmt.Errorf("failed to create ollama directory: %w", err)
 	}
-	defer resp.Body.Close()
-	if resp.StatusCode >= 300 {
-		return "", fmt.Errorf("error downloading ollama: status %s", resp.Status)
+	tempPath := executablePath + ".download"
+	file, err := os.OpenFile(tempPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o755)
+	if err != nil {
+		return fmt.Errorf("failed to create executable: %w", err)
 	}
-	length, err := io.Copy(file, resp.Body)
+	defer os.Remove(tempPath)
+	_, err = io.Copy(file, r)
+	file.Close()
 	if err != nil {
-		return "", fmt.Errorf("failed to write ollama: %w", err)
+		return fmt.Errorf("failed to write ollama: %w", err)
 	}
-	if resp.ContentLength > 0 {
-		if length < resp.ContentLength {
-			return "", fmt.Errorf("partial read downloading ollama")
-		}
+	if err = os.Chmod(tempPath, 0o755); err != nil {
+		return fmt.Errorf("failed to change ollama file mode: %w", err)
 	}
-	if err = file.Chmod(0o755); err != nil {
-		return "", fmt.Errorf("failed to change ollama file mode: %w", err)
+	if err = os.Rename(tempPath, executablePath); err != nil {
+		return fmt.Errorf("failed to write ollama: %w", err)
 	}
-	succeeded = true
-
-	return executablePath, nil
+	return nil
 }
 
 func uninstallOllama(ctx context.Context) error {
@@ -113,9 +194,13 @@ func uninstallOllama(ctx context.Context) error {
 	if err != nil {
 		return fmt.Errorf("failed to find ollama install: %w", err)
 	}
-	if err = terminateProcess(ctx, installPath); err != nil {
+	// The executable is about to be removed, so stop every process running it,
+	// not just the server the extension started.
+	report, err := terminateProcess(ctx, installPath)
+	if err != nil {
 		return fmt.Errorf("error terminating existing ollama process: %w", err)
 	}
+	report.log()
 	err = os.Remove(installPath)
 	if err != nil && !errors.Is(err, os.ErrNotExist) {
 		return err
@@ -124,52 +209,78 @@ func uninstallOllama(ctx context.Context) error {
 	return nil
 }
 
-func terminateProcess(ctx context.Context, executablePath string) error {
-	executableInfo, err := os.Stat(executablePath)
-	if err != nil {
-		if errors.Is(err, os.ErrNotExist) {
-			return nil
-		}
-		return fmt.Errorf("failed to get executable info: %w", err)
-	}
-
+// List the running processes.
+func listProcesses() ([]processInfo, error) {
 	procs, err := unix.SysctlKinfoProcSlice("kern.proc.all")
 	if err != nil {
-		return fmt.Errorf("failed to list processes: %w", err)
+		return nil, err
 	}
+	var result []processInfo
 	for _, proc := range procs {
-		pid := int(proc.Proc.P_pid)
-		buf, err := unix.SysctlRaw(CTL_KERN, KERN_PROCARGS, pid)
-		if err != nil {
-			if !errors.Is(err, unix.EINVAL) {
-				log.Printf("Failed to get command line of pid %d: %s", pid, err)
-			}
-			continue
-		}
-		// The buffer starts with a null-terminated executable path, plus
-		// command line arguments and things.
-		index := slices.Index(buf, 0)
-		if index < 0 {
-			// If we have unexpected data, don't fall over.
-			continue
+		info := processInfo{
+			PID:       int(proc.Proc.P_pid),
+			PPID:      int(proc.Eproc.Ppid),
+			StartTime: kinfoStartTime(&proc),
 		}
-		procPath := string(buf[:index])
-		procInfo, err := os.Stat(procPath)
+		buf, err := unix.SysctlRaw(CTL_KERN, KERN_PROCARGS, info.PID)
 		if err != nil {
-			continue
-		}
-		if os.SameFile(executableInfo, procInfo) {
-			process, err := os.FindProcess(pid)
-			if err != nil {
-				continue
+			if !errors.Is(err, unix.EINVAL) && !errors.Is(err, unix.EPERM) {
+				log.Printf("Failed to get command line of pid %d: %s", info.PID, err)
 			}
-			err = process.Signal(unix.SIGTERM)
-			if err == nil {
-				log.Printf("Terminated process %d", pid)
-			} else if !errors.Is(err, unix.EINVAL) {
-				log.Printf("Ignoring failure to terminate pid %d: %s", pid, err)
+		} else if index := slices.Index(buf, 0); index >= 0 {
+			// The buffer starts with a null-terminated executable path, plus
+			// command line arguments and things.
+			info.Executable = string(buf[:index])
+			if procInfo, err := os.Stat(info.Executable); err == nil {
+				info.exeInfo = procInfo
 			}
 		}
+		result = append(result, info)
 	}
-	return nil
+	return result, nil
+}
+
+// Get the start time of the process, in microseconds since the epoch.
+func kinfoStartTime(proc *unix.KinfoProc) uint64 {
+	return uint64(proc.Proc.P_starttime.Sec)*1_000_000 + uint64(proc.Proc.P_starttime.Usec)
+}
+
+// Get the start time of the given process, in microseconds since the epoch.
+func getProcessStartTime(pid int) (uint64, error) {
+	proc, err := unix.SysctlKinfoProc("kern.proc.pid", pid)
+	if err != nil {
+		return 0, err
+	}
+	if int(proc.Proc.P_pid) != pid {
+		return 0, os.ErrProcessDone
+	}
+	return kinfoStartTime(proc), nil
+}
+
+// Ask the given process to exit.
+func terminatePID(pid int) error {
+	return signalPID(pid, unix.SIGTERM)
+}
+
+// Forcibly kill the given process.
+func killPID(pid int) error {
+	return signalPID(pid, unix.SIGKILL)
+}
+
+func signalPID(pid int, signal unix.Signal) error {
+	err := unix.Kill(pid, signal)
+	if errors.Is(err, unix.ESRCH) {
+		return os.ErrProcessDone
+	}
+	return err
+}
+
+// Check if the given process is still running; zombies are not considered to
+// be running.
+func isProcessRunning(pid int) bool {
+	proc, err := unix.SysctlKinfoProc("kern.proc.pid", pid)
+	if err != nil {
+		return false
+	}
+	return int(proc.Proc.P_pid) == pid && proc.Proc.P_stat != SZOMB
 }
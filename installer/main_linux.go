@@ -1,18 +1,18 @@
 package main
 
 import (
-	"archive/tar"
-	"compress/gzip"
+	"bytes"
 	"context"
 	"errors"
 	"fmt"
 	"io"
 	"log"
-	"net/http"
 	"os"
+	"os/exec"
 	"path/filepath"
 	"runtime"
 	"strconv"
+	"strings"
 
 	"golang.org/x/sys/unix"
 )
@@ -38,116 +38,193 @@ func findExecutable(ctx context.Context, defaultOnly bool) string {
 	return ""
 }
 
-func installOllama(ctx context.Context, release, installPath string) (string, error) {
-	succeeded := false
-	executablePath := filepath.Join(installPath, "bin", "ollama")
-
-	if _, err := os.Stat(executablePath); err == nil {
-		return executablePath, nil
-	} else if !errors.Is(err, os.ErrNotExist) {
-		return "", fmt.Errorf("failed to check ollama executable: %w", err)
+// Get the base directory for per-user data, following the XDG base directory
+// specification.
+func getUserDataDir() (string, error) {
+	if dir := os.Getenv("XDG_DATA_HOME"); filepath.IsAbs(dir) {
+		return dir, nil
+	}
+	homeDir, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
 	}
+	return filepath.Join(homeDir, ".local", "share"), nil
+}
 
-	defer func() {
-		if !succeeded {
-			// On failure, remove partially extracted files.
-			_ = os.RemoveAll(installPath)
-		}
-	}()
+// Run the process in its own session, so that it is not affected by signals
+// sent to our process group.
+func detachProcess(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &unix.SysProcAttr{Setsid: true}
+}
+
+// The release archive expands to roughly this many times its download size.
+const ollamaAssetExpansion = 3
 
-	filename := "ollama-linux-amd64.tgz"
+// The oldest glibc the ollama release binaries run on.
+const minGlibcVersion = "2.28"
+
+// Get the name of the release asset containing ollama for this platform.
+func getOllamaAssetName() string {
 	if runtime.GOARCH == "arm64" {
-		filename = "ollama-linux-arm64.tgz"
+		return "ollama-linux-arm64.tgz"
 	}
-	assetURL, err := getReleaseAssetURL(ctx, release, filename)
-	if err != nil {
-		return "", err
+	return "ollama-linux-amd64.tgz"
+}
+
+// The name of the llama.cpp server executable.
+const llamaServerExecutable = "llama-server"
+
+// Get the platform in the name of the llama.cpp release asset for this
+// platform, e.g. "ubuntu-x64" in "llama-b6710-bin-ubuntu-x64.zip".
+func getLlamaCppAssetPlatform() string {
+	if runtime.GOARCH == "arm64" {
+		return "ubuntu-arm64"
 	}
+	return "ubuntu-x64"
+}
 
-	log.Printf("Downloading ollama from %s...", assetURL)
+// Check for Linux specific problems: the install directory being on a noexec
+// mount, and a C library ollama cannot run with.
+func platformPreflightChecks(ctx context.Context, dir string) []preflightFinding {
+	var findings []preflightFinding
+	var stat unix.Statfs_t
+	if err := unix.Statfs(dir, &stat); err != nil {
+		findings = append(findings, preflightFinding{Check: "noexec", Severity: preflightWarning,
+			Message: fmt.Sprintf("failed to check mount options of %s: %s", dir, err)})
+	} else if stat.Flags&unix.ST_NOEXEC != 0 {
+		findings = append(findings, preflightFinding{Check: "noexec", Severity: preflightBlocking,
+			Message: fmt.Sprintf("%s is on a file system mounted noexec", dir)})
+	}
 
-	// For Linux, Ollama is an archive that we need to extract.
-	//TODO: Support ROCm
-	req, err := http.NewRequestWithContext(ctx, http.MethodGet, assetURL, nil)
+	output, err := exec.CommandContext(ctx, "getconf", "GNU_LIBC_VERSION").Output()
 	if err != nil {
-		return "", fmt.Errorf("failed to create request: %w", err)
+		if musl, _ := filepath.Glob("/lib/ld-musl-*"); len(musl) > 0 {
+			findings = append(findings, preflightFinding{Check: "libc", Severity: preflightBlocking,
+				Message: "ollama requires glibc, but this system uses musl"})
+		} else {
+			findings = append(findings, preflightFinding{Check: "libc", Severity: preflightWarning,
+				Message: fmt.Sprintf("failed to determine the glibc version: %s", err)})
+		}
+		return findings
 	}
-	resp, err := http.DefaultClient.Do(req)
-	if err != nil {
-		return "", fmt.Errorf("failed to download ollama: %w", err)
+	// The output looks like "glibc 2.35".
+	version := strings.TrimPrefix(strings.TrimSpace(string(output)), "glibc ")
+	if compareVersions(version, minGlibcVersion) < 0 {
+		findings = append(findings, preflightFinding{Check: "libc", Severity: preflightBlocking,
+			Message: fmt.Sprintf("ollama requires glibc %s or later, but this system has %s", minGlibcVersion, version)})
 	}
-	if resp.StatusCode >= 300 {
-		return "", fmt.Errorf("error downloading ollama: status %s", resp.Status)
+	return findings
+}
+
+// Get the total physical memory, in bytes.
+func getTotalMemory() (uint64, error) {
+	var info unix.Sysinfo_t
+	if err := unix.Sysinfo(&info); err != nil {
+		return 0, err
 	}
-	defer resp.Body.Close()
+	return uint64(info.Totalram) * uint64(info.Unit), nil
+}
 
-	gzipReader, err := gzip.NewReader(resp.Body)
-	if err != nil {
-		return "", fmt.Errorf("failed to read gzip archive: %w", err)
-	}
-	tarReader := tar.NewReader(gzipReader)
-	var links []tar.Header
-	for {
-		header, err := tarReader.Next()
-		if errors.Is(err, io.EOF) {
-			break
-		}
+// Find the process listening on the given TCP port; returns zero if there is
+// none.  This matches the socket inodes in /proc/net/tcp against the open
+// files of each process, so processes of other users may not be found.
+func findPortOwner(ctx context.Context, port int) (int, error) {
+	inodes := make(map[string]bool)
+	for _, table := range []string{"/proc/net/tcp", "/proc/net/tcp6"} {
+		buf, err := os.ReadFile(table)
 		if err != nil {
-			return "", fmt.Errorf("error reading tar archive: %w", err)
-		}
-		if !filepath.IsLocal(header.Name) {
-			return "", fmt.Errorf("error extracting archive: path %s: %w", header.Name, tar.ErrInsecurePath)
-		}
-		outPath := filepath.Join(installPath, header.Name)
-		info := header.FileInfo()
-		switch header.Typeflag {
-		case tar.TypeDir:
-			if err = os.MkdirAll(outPath, info.Mode()); err != nil {
-				return "", fmt.Errorf("error extracting %s: failed to make directory: %w", header.Name, err)
+			if errors.Is(err, os.ErrNotExist) {
+				continue
 			}
-			if err = os.Chmod(outPath, header.FileInfo().Mode()); err != nil {
-				return "", fmt.Errorf("error extracting %s: failed to change permissions: %w", header.Name, err)
-			}
-		case tar.TypeReg:
-			file, err := os.OpenFile(outPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, info.Mode())
-			if err != nil {
-				return "", fmt.Errorf("error extracting %s: failed to create file: %w", header.Name, err)
-			}
-			n, err := io.Copy(file, tarReader)
-			file.Close()
-			if err != nil {
-				return "", fmt.Errorf("error extracting %s: failed to copy: %w", header.Name, err)
+			return 0, err
+		}
+		for _, line := range strings.Split(string(buf), "\n")[1:] {
+			fields := strings.Fields(line)
+			// Fields are: sl, local address, remote address, state, ..., inode.
+			if len(fields) < 10 || fields[3] != "0A" { // TCP_LISTEN
+				continue
 			}
-			if n < header.Size {
-				return "", fmt.Errorf("error extracting %s: extracted %d of %d bytes", header.Name, n, header.Size)
+			_, portHex, ok := strings.Cut(fields[1], ":")
+			if !ok {
+				continue
 			}
-		case tar.TypeLink, tar.TypeSymlink:
-			// defer hard & symlink creation until the files exist; note we copy here.
-			if !filepath.IsLocal(header.Linkname) {
-				return "", fmt.Errorf("error extracting %s: %w", header.Name, tar.ErrInsecurePath)
+			if localPort, err := strconv.ParseInt(portHex, 16, 32); err == nil && int(localPort) == port {
+				inodes["socket:["+fields[9]+"]"] = true
 			}
-			links = append(links, *header)
-		default:
-			return "", fmt.Errorf("error extracting %s: don't know how to handle %v", header.Name, header.Typeflag)
 		}
 	}
-
-	for _, link := range links {
-		newName := filepath.Join(installPath, link.Name)
-		oldName := filepath.Join(installPath, link.Linkname)
-		if link.Typeflag == tar.TypeLink {
-			err = os.Link(oldName, newName)
-		} else {
-			err = os.Symlink(oldName, newName)
+	if len(inodes) == 0 {
+		return 0, nil
+	}
+	pidfds, err := os.ReadDir("/proc")
+	if err != nil {
+		return 0, err
+	}
+	for _, pidfd := range pidfds {
+		pid, err := strconv.Atoi(pidfd.Name())
+		if err != nil {
+			continue
 		}
+		fdDir := filepath.Join("/proc", pidfd.Name(), "fd")
+		fds, err := os.ReadDir(fdDir)
 		if err != nil {
-			return "", fmt.Errorf("error extracting %s: could not create link: %w", link.Name, err)
+			continue
+		}
+		for _, fd := range fds {
+			if target, err := os.Readlink(filepath.Join(fdDir, fd.Name())); err == nil && inodes[target] {
+				return pid, nil
+			}
 		}
 	}
+	return 0, fmt.Errorf("port %d is in use by a process that could not be identified", port)
+}
+
+func installOllama(ctx context.Context, release, installPath string) (string, *assetInfo, error) {
+	succeeded := false
+	executablePath := filepath.Join(installPath, "bin", "ollama")
+
+	if _, err := os.Stat(executablePath); err == nil {
+		return executablePath, nil, nil
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return "", nil, fmt.Errorf("failed to check ollama executable: %w", err)
+	}
+
+	defer func() {
+		if !succeeded {
+			// On failure, remove partially extracted files.
+			_ = os.RemoveAll(installPath)
+		}
+	}()
+
+	asset, err := getReleaseAsset(ctx, release, getOllamaAssetName())
+	if err != nil {
+		return "", nil, err
+	}
+	download, err := downloadAsset(ctx, asset)
+	if err != nil {
+		return "", nil, err
+	}
+	defer download.Close()
+
+	//TODO: Support ROCm
+	if err = extractOllama(ctx, download, installPath, nil); err != nil {
+		return "", nil, err
+	}
+	if asset.Digest, err = download.finish(); err != nil {
+		return "", nil, err
+	}
 
 	succeeded = true
 
-	return executablePath, nil
+	return executablePath, asset, nil
+}
+
+// Extract the ollama release archive into the install directory.  If include
+// is set, only the files (relative to the install directory) for which it
+// returns true are extracted; existing files are replaced.
+func extractOllama(ctx context.Context, r io.Reader, installPath string, include func(name string) bool) error {
+	// For Linux, Ollama is an archive that we need to extract.
+	return extractTarGz(ctx, r, installPath, ollamaExtractLimits, include)
 }
 
 func uninstallOllama(ctx context.Context) error {
@@ -157,9 +234,13 @@ func uninstallOllama(ctx context.Context) error {
 	}
 
 	executablePath := filepath.Join(installDir, "bin", "ollama")
-	if err = terminateProcess(ctx, executablePath); err != nil {
+	// The executable is about to be removed, so stop every process running it,
+	// not just the server the extension started.
+	report, err := terminateProcess(ctx, executablePath)
+	if err != nil {
 		return fmt.Errorf("error terminating existing ollama process: %w", err)
 	}
+	report.log()
 
 	err = os.RemoveAll(installDir)
 	if err != nil && !errors.Is(err, os.ErrNotExist) {
@@ -169,20 +250,13 @@ func uninstallOllama(ctx context.Context) error {
 	return nil
 }
 
-func terminateProcess(ctx context.Context, executablePath string) error {
-	executableInfo, err := os.Stat(executablePath)
-	if err != nil {
-		if errors.Is(err, os.ErrNotExist) {
-			return nil
-		}
-		return fmt.Errorf("failed to get executable info: %w", err)
-	}
-
-	// Check /proc/<pid>/exe to see if they're the correct file.
+// List the running processes, using /proc.
+func listProcesses() ([]processInfo, error) {
 	pidfds, err := os.ReadDir("/proc")
 	if err != nil {
-		return fmt.Errorf("error listing processes: %w", err)
+		return nil, err
 	}
+	var procs []processInfo
 	for _, pidfd := range pidfds {
 		if !pidfd.IsDir() {
 			continue
@@ -191,27 +265,90 @@ func terminateProcess(ctx context.Context, executablePath string) error {
 		if err != nil {
 			continue
 		}
-		exeInfo, err := os.Stat(filepath.Join("/proc", pidfd.Name(), "exe"))
+		stat, err := readProcStat(pid)
 		if err != nil {
-			if !errors.Is(err, os.ErrNotExist) && !errors.Is(err, os.ErrPermission) {
-				log.Printf("Failed to get executable of process %s: %s", pidfd.Name(), err)
-			}
 			continue
 		}
-		if !os.SameFile(executableInfo, exeInfo) {
-			continue
-		}
-		proc, err := os.FindProcess(pid)
-		if err != nil {
-			continue
-		}
-		err = proc.Signal(unix.SIGTERM)
-		if err == nil {
-			log.Printf("Terminated process %d", pid)
-		} else if !errors.Is(err, unix.EINVAL) {
-			log.Printf("Ignoring failure to terminate pid %d: %s", pid, err)
+		proc := processInfo{PID: pid, PPID: stat.ppid, StartTime: stat.startTime}
+		exeLink := filepath.Join("/proc", pidfd.Name(), "exe")
+		if exeInfo, err := os.Stat(exeLink); err == nil {
+			proc.exeInfo = exeInfo
+			proc.Executable, _ = os.Readlink(exeLink)
+		} else if !errors.Is(err, os.ErrNotExist) && !errors.Is(err, os.ErrPermission) {
+			log.Printf("Failed to get executable of process %s: %s", pidfd.Name(), err)
 		}
+		procs = append(procs, proc)
 	}
+	return procs, nil
+}
 
-	return nil
+// procStat holds the fields we use from /proc/<pid>/stat.
+type procStat struct {
+	state     byte
+	ppid      int
+	startTime uint64 // In clock ticks since boot.
+}
+
+func readProcStat(pid int) (*procStat, error) {
+	buf, err := os.ReadFile(filepath.Join("/proc", strconv.Itoa(pid), "stat"))
+	if err != nil {
+		return nil, err
+	}
+	// The command name is in parentheses and may contain spaces; the fields we
+	// need come after it.
+	index := bytes.LastIndexByte(buf, ')')
+	if index < 0 {
+		return nil, fmt.Errorf("unexpected contents in /proc/%d/stat", pid)
+	}
+	// Field numbers are from proc(5); the first field here is field 3.
+	fields := strings.Fields(string(buf[index+1:]))
+	if len(fields) < 20 || len(fields[0]) != 1 {
+		return nil, fmt.Errorf("unexpected contents in /proc/%d/stat", pid)
+	}
+	ppid, err := strconv.Atoi(fields[4-3])
+	if err != nil {
+		return nil, fmt.Errorf("unexpected parent pid in /proc/%d/stat: %w", pid, err)
+	}
+	startTime, err := strconv.ParseUint(fields[22-3], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("unexpected start time in /proc/%d/stat: %w", pid, err)
+	}
+	return &procStat{state: fields[0][0], ppid: ppid, startTime: startTime}, nil
+}
+
+// Get the start time of the given process, in clock ticks since boot.
+func getProcessStartTime(pid int) (uint64, error) {
+	stat, err := readProcStat(pid)
+	if err != nil {
+		return 0, err
+	}
+	return stat.startTime, nil
+}
+
+// Ask the given process to exit.
+func terminatePID(pid int) error {
+	return signalPID(pid, unix.SIGTERM)
+}
+
+// Forcibly kill the given process.
+func killPID(pid int) error {
+	return signalPID(pid, unix.SIGKILL)
+}
+
+func signalPID(pid int, signal unix.Signal) error {
+	err := unix.Kill(pid, signal)
+	if errors.Is(err, unix.ESRCH) {
+		return os.ErrProcessDone
+	}
+	return err
+}
+
+// Check if the given process is still running; zombies are not considered to
+// be running.
+func isProcessRunning(pid int) bool {
+	stat, err := readProcStat(pid)
+	if err != nil {
+		return false
+	}
+	return stat.state != 'Z' && stat.state != 'X'
 }
@@ -1,21 +1,18 @@
 package main
 
 import (
-	"archive/zip"
 	"context"
 	"errors"
 	"fmt"
 	"io"
-	"log"
-	"net/http"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"runtime"
+	"strconv"
 	"strings"
-	"time"
 	"unsafe"
 
-	"github.com/xenking/zipstream"
 	"golang.org/x/sys/windows"
 )
 
@@ -46,14 +43,100 @@ func findExecutable(ctx context.Context, defaultOnly bool) string {
 	return ""
 }
 
-func installOllama(ctx context.Context, release, installPath string) (string, error) {
+// Get the base directory for per-user data: %LocalAppData%, as models are too
+// large to be in the roaming profile.
+func getUserDataDir() (string, error) {
+	return os.UserCacheDir()
+}
+
+// Run the process in its own process group without a console, so that it is
+// not affected by console control events sent to us.
+func detachProcess(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &windows.SysProcAttr{
+		CreationFlags: windows.CREATE_NEW_PROCESS_GROUP | windows.DETACHED_PROCESS,
+	}
+}
+
+// The release archive expands to roughly this many times its download size.
+const ollamaAssetExpansion = 3
+
+// Get the name of the release asset containing ollama for this platform.
+func getOllamaAssetName() string {
+	return "ollama-windows-amd64.zip"
+}
+
+// The name of the llama.cpp server executable.
+const llamaServerExecutable = "llama-server.exe"
+
+// Get the platform in the name of the llama.cpp release asset for this
+// platform, e.g. "win-cpu-x64" in "llama-b6710-bin-win-cpu-x64.zip".  The
+// CPU build is used, as it runs everywhere.
+func getLlamaCppAssetPlatform() string {
+	if runtime.GOARCH == "arm64" {
+		return "win-cpu-arm64"
+	}
+	return "win-cpu-x64"
+}
+
+// There are no Windows specific preflight checks.
+func platformPreflightChecks(ctx context.Context, dir string) []preflightFinding {
+	return nil
+}
+
+// memoryStatusEx is MEMORYSTATUSEX, which x/sys/windows does not define.
+type memoryStatusEx struct {
+	Length               uint32
+	MemoryLoad           uint32
+	TotalPhys            uint64
+	AvailPhys            uint64
+	TotalPageFile        uint64
+	AvailPageFile        uint64
+	TotalVirtual         uint64
+	AvailVirtual         uint64
+	AvailExtendedVirtual uint64
+}
+
+var procGlobalMemoryStatusEx = windows.NewLazySystemDLL("kernel32.dll").NewProc("GlobalMemoryStatusEx")
+
+// Get the total physical memory, in bytes.
+func getTotalMemory() (uint64, error) {
+	status := memoryStatusEx{}
+	status.Length = uint32(unsafe.Sizeof(status))
+	if ret, _, err := procGlobalMemoryStatusEx.Call(uintptr(unsafe.Pointer(&status))); ret == 0 {
+		return 0, err
+	}
+	return status.TotalPhys, nil
+}
+
+// Find the process listening on the given TCP port, using netstat; returns
+// zero if there is none.
+func findPortOwner(ctx context.Context, port int) (int, error) {
+	cmd := exec.CommandContext(ctx, "netstat", "-a", "-n", "-o", "-p", "TCP")
+	cmd.SysProcAttr = &windows.SysProcAttr{HideWindow: true}
+	output, err := cmd.Output()
+	if err != nil {
+		return 0, fmt.Errorf("failed to run netstat: %w", err)
+	}
+	suffix := fmt.Sprintf(":%d", port)
+	for _, line := range strings.Split(string(output), "\n") {
+		// Lines look like: TCP  127.0.0.1:11434  0.0.0.0:0  LISTENING  1234
+		fields := strings.Fields(line)
+		if len(fields) != 5 || fields[3] != "LISTENING" || !strings.HasSuffix(fields[1], suffix) {
+			continue
+		}
+		return strconv.Atoi(fields[4])
+	}
+	return 0, nil
+}
+
+func installOllama(ctx context.Context, release, installPath string) (string, *assetInfo, error) {
 	succeeded := false
 	executablePath := filepath.Join(installPath, "ollama.exe")
 
 	if _, err := os.Stat(executablePath); err == nil {
-		return executablePath, nil
+		return executablePath, nil, nil
 	} else if !errors.Is(err, os.ErrNotExist) {
-		return "", fmt.Errorf("failed to check ollama executable: %w", err)
+		return "", nil, fmt.Errorf("failed to check ollama executable: %w", err)
 	}
 
 	defer func() {
@@ -63,75 +146,34 @@ func installOllama(ctx context.Context, release, installPath string) (string, er
 		}
 	}()
 
-	assetURL, err := getReleaseAssetURL(ctx, release, "ollama-windows-amd64.zip")
+	asset, err := getReleaseAsset(ctx, release, getOllamaAssetName())
 	if err != nil {
-		return "", err
+		return "", nil, err
 	}
-
-	log.Printf("Downloading ollama from %s...", assetURL)
-
-	// For Windows, Ollama is a zip archive that we need  to extract.
-	req, err := http.NewRequestWithContext(ctx, http.MethodGet, assetURL, nil)
+	download, err := downloadAsset(ctx, asset)
 	if err != nil {
-		return "", fmt.Errorf("failed to create request: %w", err)
-	}
-	resp, err := http.DefaultClient.Do(req)
-	if err != nil {
-		return "", fmt.Errorf("failed to download ollama: %w", err)
-	}
-	defer resp.Body.Close()
-	if resp.StatusCode >= 300 {
-		return "", fmt.Errorf("error downloading ollama: status %s", resp.Status)
+		return "", nil, err
 	}
+	defer download.Close()
 
-	zipReader := zipstream.NewReader(resp.Body)
-	for {
-		info, err := zipReader.Next()
-		if errors.Is(err, io.EOF) {
-			break
-		}
-		if err != nil {
-			return "", fmt.Errorf("error reading ollama archive: %w", err)
-		}
-		if !filepath.IsLocal(info.Name) || strings.ContainsRune(info.Name, '\\') {
-			return "", fmt.Errorf("error extracting archive: %s: %w", info.Name, zip.ErrInsecurePath)
-		}
-		outPath := filepath.Join(installPath, info.Name)
-		if strings.HasSuffix(info.Name, "/") {
-			if err = os.MkdirAll(outPath, info.Mode()); err != nil {
-				return "", fmt.Errorf("error extracting archive: %s: %w", info.Name, err)
-			}
-		} else {
-			if err = os.MkdirAll(filepath.Dir(outPath), 0o755); err != nil {
-				return "", fmt.Errorf("error extracting archive: %s: failed to create parent: %w", info.Name, err)
-			}
-			file, err := os.OpenFile(outPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, info.Mode())
-			if err != nil {
-				return "", fmt.Errorf("error extracting archive: %s: %w", info.Name, err)
-			}
-			n, err := io.Copy(file, zipReader)
-			if err != nil {
-				return "", fmt.Errorf("error extracting archive: %s: %w", info.Name, err)
-			}
-			if n < int64(info.UncompressedSize64) {
-				return "", fmt.Errorf("error extracting archive: %s: extracted %d of %d bytes", info.Name, n, info.UncompressedSize64)
-			}
-		}
+	if err = extractOllama(ctx, download, installPath, nil); err != nil {
+		return "", nil, err
 	}
-
-	// Anti-virus might have locked the executable; try to run `--version` until
-	// it succeeds before returning.
-	for i := 0; i < 60; i++ {
-		err = exec.CommandContext(ctx, executablePath, "--version").Run()
-		if err == nil {
-			break
-		}
-		time.Sleep(time.Second)
+	if asset.Digest, err = download.finish(); err != nil {
+		return "", nil, err
 	}
 
 	succeeded = true
 
-	return executablePath, nil
+	return executablePath, asset, nil
+}
+
+// Extract the ollama release archive into the install directory.  If include
+// is set, only the files (relative to the install directory) for which it
+// returns true are extracted; existing files are replaced.
+func extractOllama(ctx context.Context, r io.Reader, installPath string, include func(name string) bool) error {
+	// For Windows, Ollama is a zip archive that we need  to extract.
+	return extractZip(ctx, r, installPath, ollamaExtractLimits, include)
 }
 
 func uninstallOllama(ctx context.Context) error {
@@ -140,9 +182,13 @@ func uninstallOllama(ctx context.Context) error {
 		return fmt.Errorf("failed to find ollama install: %w", err)
 	}
 	executablePath := filepath.Join(installDir, "ollama.exe")
-	if err = terminateProcess(ctx, executablePath); err != nil {
+	// The executable is about to be removed, so stop every process running it,
+	// not just the server the extension started.
+	report, err := terminateProcess(ctx, executablePath)
+	if err != nil {
 		return fmt.Errorf("error terminating existing ollama process: %w", err)
 	}
+	report.log()
 
 	err = os.RemoveAll(installDir)
 	if err != nil && !errors.Is(err, os.ErrNotExist) {
@@ -152,78 +198,108 @@ func uninstallOllama(ctx context.Context) error {
 	return nil
 }
 
-// terminateProcess terminates the ollama process; this is required because on
-// Windows running processes cannot be deleted.
-func terminateProcess(ctx context.Context, executablePath string) error {
-
-	ollamaInfo, err := os.Stat(executablePath)
+// List the running processes.
+func listProcesses() ([]processInfo, error) {
+	snapshot, err := windows.CreateToolhelp32Snapshot(windows.TH32CS_SNAPPROCESS, 0)
 	if err != nil {
-		if errors.Is(err, os.ErrNotExist) {
-			return nil
-		}
-		return fmt.Errorf("error examining ollama executable: %w", err)
+		return nil, fmt.Errorf("failed to snapshot processes: %w", err)
 	}
+	defer windows.CloseHandle(snapshot)
 
-	pids := make([]uint32, 4096)
-	// Try EnumProcesses until the number of pids returned is less than the
-	// buffer size.
-	for {
-		var bytesReturned uint32
-		err := windows.EnumProcesses(pids, &bytesReturned)
-		if err != nil || len(pids) < 1 {
-			return fmt.Errorf("failed to enumerate processes: %w", err)
+	var procs []processInfo
+	entry := windows.ProcessEntry32{Size: uint32(unsafe.Sizeof(windows.ProcessEntry32{}))}
+	for err = windows.Process32First(snapshot, &entry); err == nil; err = windows.Process32Next(snapshot, &entry) {
+		proc := processInfo{
+			PID:        int(entry.ProcessID),
+			PPID:       int(entry.ParentProcessID),
+			Executable: windows.UTF16ToString(entry.ExeFile[:]),
 		}
-		pidsReturned := uintptr(bytesReturned) / unsafe.Sizeof(pids[0])
-		if pidsReturned < uintptr(len(pids)) {
-			// Remember to truncate the pids to only the valid set.
-			pids = pids[:pidsReturned]
-			break
+		if startTime, err := getProcessStartTime(proc.PID); err == nil {
+			proc.StartTime = startTime
 		}
-		pids = make([]uint32, len(pids)*2)
-	}
-
-	for _, pid := range pids {
-		// Do each iteration in a function so defer statements run faster.
-		err := (func() error {
-			hProc, err := windows.OpenProcess(
-				windows.PROCESS_QUERY_LIMITED_INFORMATION|windows.PROCESS_TERMINATE,
-				false,
-				pid)
-			if err != nil {
-				log.Printf("Ignoring error opening process %d: %s", pid, err)
-				return nil
-			}
-			defer windows.CloseHandle(hProc)
-
-			nameBuf := make([]uint16, 1024)
-			for {
-				bufSize := uint32(len(nameBuf))
-				err = windows.QueryFullProcessImageName(hProc, 0, &nameBuf[0], &bufSize)
-				if err != nil {
-					return fmt.Errorf("error getting process %d executable: %w", pid, err)
-				}
-				if int(bufSize) < len(nameBuf) {
-					break
-				}
-				nameBuf = make([]uint16, len(nameBuf)*2)
-			}
-			executablePath := windows.UTF16ToString(nameBuf)
-			executableInfo, err := os.Stat(executablePath)
-			if err != nil {
-				return nil
-			}
-			if os.SameFile(ollamaInfo, executableInfo) {
-				if err = windows.TerminateProcess(hProc, 0); err != nil {
-					return fmt.Errorf("failed to terminate pid %d (%s): %w", pid, executablePath, err)
-				}
+		if executablePath, err := getProcessImageName(entry.ProcessID); err == nil {
+			proc.Executable = executablePath
+			if executableInfo, err := os.Stat(executablePath); err == nil {
+				proc.exeInfo = executableInfo
 			}
+		}
+		procs = append(procs, proc)
+	}
+	if !errors.Is(err, windows.ERROR_NO_MORE_FILES) {
+		return nil, fmt.Errorf("failed to enumerate processes: %w", err)
+	}
+	return procs, nil
+}
+
+// Get the full path to the executable of the given process.
+func getProcessImageName(pid uint32) (string, error) {
+	hProc, err := windows.OpenProcess(windows.PROCESS_QUERY_LIMITED_INFORMATION, false, pid)
+	if err != nil {
+		return "", err
+	}
+	defer windows.CloseHandle(hProc)
 
-			return nil
-		})()
+	nameBuf := make([]uint16, 1024)
+	for {
+		bufSize := uint32(len(nameBuf))
+		err = windows.QueryFullProcessImageName(hProc, 0, &nameBuf[0], &bufSize)
 		if err != nil {
-			log.Printf("%s", err)
+			return "", fmt.Errorf("error getting process %d executable: %w", pid, err)
 		}
+		if int(bufSize) < len(nameBuf) {
+			break
+		}
+		nameBuf = make([]uint16, len(nameBuf)*2)
 	}
+	return windows.UTF16ToString(nameBuf), nil
+}
+
+// Get the creation time of the given process, in 100-nanosecond intervals
+// since January 1, 1601.
+func getProcessStartTime(pid int) (uint64, error) {
+	hProc, err := windows.OpenProcess(windows.PROCESS_QUERY_LIMITED_INFORMATION, false, uint32(pid))
+	if err != nil {
+		return 0, err
+	}
+	defer windows.CloseHandle(hProc)
+	var creationTime, exitTime, kernelTime, userTime windows.Filetime
+	if err = windows.GetProcessTimes(hProc, &creationTime, &exitTime, &kernelTime, &userTime); err != nil {
+		return 0, err
+	}
+	return uint64(creationTime.HighDateTime)<<32 | uint64(creationTime.LowDateTime), nil
+}
 
+// Ask the given process to exit.  Windows has no equivalent of SIGTERM for
+// processes without a console (and the server is started detached from ours),
+// so the caller kills the process instead; it must be stopped as running
+// executables cannot be deleted.
+func terminatePID(pid int) error {
+	return errNoGracefulStop
+}
+
+// Forcibly kill the given process.
+func killPID(pid int) error {
+	hProc, err := windows.OpenProcess(windows.PROCESS_TERMINATE, false, uint32(pid))
+	if err != nil {
+		if errors.Is(err, windows.ERROR_INVALID_PARAMETER) {
+			return os.ErrProcessDone
+		}
+		return err
+	}
+	defer windows.CloseHandle(hProc)
+	if err = windows.TerminateProcess(hProc, 0); err != nil {
+		return fmt.Errorf("failed to terminate pid %d: %w", pid, err)
+	}
 	return nil
 }
+
+// Check if the given process is still running.
+func isProcessRunning(pid int) bool {
+	hProc, err := windows.OpenProcess(windows.SYNCHRONIZE, false, uint32(pid))
+	if err != nil {
+		return false
+	}
+	defer windows.CloseHandle(hProc)
+	event, err := windows.WaitForSingleObject(hProc, 0)
+	return err == nil && event == uint32(windows.WAIT_TIMEOUT)
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// The subdirectory of the cache directory holding GitHub API responses.
+const metadataCacheDirName = "metadata"
+
+// metadataEntry is a cached GitHub API response, along with what is needed to
+// make a conditional request for it.
+type metadataEntry struct {
+	URL          string          `json:"url"`
+	ETag         string          `json:"etag,omitempty"`
+	LastModified string          `json:"lastModified,omitempty"`
+	Link         string          `json:"link,omitempty"` // For paged responses.
+	Fetched      time.Time       `json:"fetched"`        // When the response was last known current.
+	Body         json.RawMessage `json:"body"`
+	// Cached is set if the response could not be checked against the
+	// server, because it could not be reached.
+	Cached bool `json:"-"`
+}
+
+// Get the path of the cache file for the URL.
+func getMetadataCachePath(ctx context.Context, url string) (string, error) {
+	cacheDir, err := getCacheLocation(ctx)
+	if err != nil {
+		return "", fmt.Errorf("failed to find cache directory: %w", err)
+	}
+	sum := sha256.Sum256([]byte(url))
+	return filepath.Join(cacheDir, metadataCacheDirName, hex.EncodeToString(sum[:16])+".json"), nil
+}
+
+// Read the cached response for the URL; returns nil if there is none.
+func readMetadataCache(path, url string) *metadataEntry {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			log.Printf("Ignoring unreadable metadata cache %s: %s", path, err)
+		}
+		return nil
+	}
+	var entry metadataEntry
+	if err = json.Unmarshal(buf, &entry); err != nil || entry.URL != url {
+		log.Printf("Ignoring invalid metadata cache %s", path)
+		return nil
+	}
+	return &entry
+}
+
+func writeMetadataCache(path string, entry *metadataEntry) error {
+	buf, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	// Write to a temporary file first, so concurrent readers never see a
+	// partial file.
+	file, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(buf)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(file.Name(), path)
+	}
+	if err != nil {
+		_ = os.Remove(file.Name())
+	}
+	return err
+}
+
+// Get a JSON response from the GitHub API, using the on-disk cache.  If the
+// response is cached, a conditional request is made, and the cached response
+// is used if the server reports it has not changed; these requests do not
+// count towards the rate limit.  If the server cannot be reached (or refuses
+// the request due to rate limiting), the cached response is used regardless
+// of its age.
+func fetchMetadata(ctx context.Context, url string) (*metadataEntry, error) {
+	cachePath, err := getMetadataCachePath(ctx, url)
+	if err != nil {
+		return nil, err
+	}
+	cached := readMetadataCache(cachePath, url)
+	// Don't retry for long if there is something to fall back on.
+	policy := remoteRetryPolicy
+	if cached != nil {
+		policy = cachedRetryPolicy
+	}
+	useCached := func(reason string) (*metadataEntry, error) {
+		log.Printf("Using cached %s from %s (%s).", url, cached.Fetched.Local().Format(time.RFC1123), reason)
+		cached.Cached = true
+		return cached, nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/vnd.github+json")
+	if cached != nil {
+		if cached.ETag != "" {
+			req.Header.Set("If-None-Match", cached.ETag)
+		}
+		if cached.LastModified != "" {
+			req.Header.Set("If-Modified-Since", cached.LastModified)
+		}
+	}
+	resp, err := doWithRetry(ctx, req, policy)
+	if err != nil {
+		if cached != nil && ctx.Err() == nil {
+			return useCached(err.Error())
+		}
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusNotModified && cached != nil:
+		cached.Fetched = time.Now().UTC()
+		if err = writeMetadataCache(cachePath, cached); err != nil {
+			log.Printf("Failed to update metadata cache: %s", err)
+		}
+		return cached, nil
+	case resp.StatusCode >= 300:
+		// GitHub reports rate limiting as 403 (or 429); as with server
+		// errors, fall back on the cache.
+		if cached != nil && (resp.StatusCode == http.StatusForbidden || resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500) {
+			return useCached("status " + resp.Status)
+		}
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		if cached != nil && ctx.Err() == nil {
+			return useCached(err.Error())
+		}
+		return nil, fmt.Errorf("reading response: %w", err)
+	}
+	if !json.Valid(body) {
+		return nil, fmt.Errorf("response is not valid JSON")
+	}
+	entry := &metadataEntry{
+		URL:          url,
+		ETag:         resp.Header.Get("ETag"),
+		LastModified: resp.Header.Get("Last-Modified"),
+		Link:         resp.Header.Get("Link"),
+		Fetched:      time.Now().UTC(),
+		Body:         body,
+	}
+	if err = writeMetadataCache(cachePath, entry); err != nil {
+		log.Printf("Failed to write metadata cache: %s", err)
+	}
+	return entry, nil
+}
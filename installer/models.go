@@ -0,0 +1,452 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+var (
+	modelsSource string
+	exportModels string // See uninstallFlags.
+)
+
+// Register the flags used to import or share external models.
+func modelsSourceFlags(flags *flag.FlagSet) {
+	flags.StringVar(&modelsSource, "from", "", "models directory of an external ollama install to import or share; defaults to the first one detected")
+}
+
+// The registry and namespace ollama uses for unqualified model names.
+const (
+	defaultModelRegistry  = "registry.ollama.ai"
+	defaultModelNamespace = "library"
+)
+
+// modelManifest is the subset of an ollama model manifest that we use.
+type modelManifest struct {
+	Config modelLayer   `json:"config"`
+	Layers []modelLayer `json:"layers"`
+}
+
+type modelLayer struct {
+	Digest string `json:"digest"`
+	Size   int64  `json:"size"`
+}
+
+// localModel is a model stored in an ollama models directory.
+type localModel struct {
+	Name         string // e.g. "tinyllama:latest"
+	ManifestPath string // Relative to the manifests directory.
+	Manifest     modelManifest
+}
+
+// externalModels describes an ollama models directory not managed by us.
+type externalModels struct {
+	Path   string   `json:"path"`
+	Models []string `json:"models"`
+	Size   int64    `json:"size"` // In bytes.
+	Shared bool     `json:"shared"`
+}
+
+// Get the locations where other ollama installs typically keep their models.
+func getExternalModelsCandidates() []string {
+	var candidates []string
+	if dir := os.Getenv("OLLAMA_MODELS"); dir != "" {
+		candidates = append(candidates, dir)
+	}
+	if homeDir, err := os.UserHomeDir(); err == nil {
+		candidates = append(candidates, filepath.Join(homeDir, ".ollama", "models"))
+	}
+	if runtime.GOOS == "linux" {
+		// The Linux install script runs ollama as a system user.
+		candidates = append(candidates, "/usr/share/ollama/.ollama/models")
+	}
+	return candidates
+}
+
+// Find ollama models directories belonging to other installs; the directory
+// we are configured to use is included (and marked as shared) if it is not
+// the default managed location.
+func detectExternalModels(ctx context.Context) ([]externalModels, error) {
+	modelsDir, err := getModelsLocation(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find models directory: %w", err)
+	}
+	var result []externalModels
+	for _, candidate := range getExternalModelsCandidates() {
+		if filepath.Clean(candidate) == filepath.Clean(modelsDir) && !isModelsDirShared(modelsDir) {
+			continue
+		}
+		if slicesContainsPath(result, candidate) {
+			continue
+		}
+		models, err := listLocalModels(candidate)
+		if err != nil {
+			if !errors.Is(err, fs.ErrNotExist) && !errors.Is(err, fs.ErrPermission) {
+				log.Printf("Ignoring models directory %s: %s", candidate, err)
+			}
+			continue
+		}
+		size, err := directorySize(candidate)
+		if err != nil {
+			log.Printf("Failed to get size of %s: %s", candidate, err)
+		}
+		entry := externalModels{Path: candidate, Size: size, Models: []string{}}
+		for _, model := range models {
+			entry.Models = append(entry.Models, model.Name)
+		}
+		entry.Shared = filepath.Clean(candidate) == filepath.Clean(modelsDir)
+		result = append(result, entry)
+	}
+	return result, nil
+}
+
+func slicesContainsPath(entries []externalModels, path string) bool {
+	for _, entry := range entries {
+		if filepath.Clean(entry.Path) == filepath.Clean(path) {
+			return true
+		}
+	}
+	return false
+}
+
+// Check if the models directory is shared with an external install, rather
+// than being owned by the extension; this is recorded by shareModels.
+func isModelsDirShared(modelsDir string) bool {
+	return config.Paths.SharedModels != "" && filepath.Clean(config.Paths.SharedModels) == filepath.Clean(modelsDir)
+}
+
+// contextReader fails reads once its context is done, so that copying large
+// files can be cancelled.
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (r contextReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.r.Read(p)
+}
+
+// List the models in an ollama models directory.
+func listLocalModels(modelsDir string) ([]localModel, error) {
+	manifestsDir := filepath.Join(modelsDir, "manifests")
+	if _, err := os.Stat(manifestsDir); err != nil {
+		return nil, err
+	}
+	var models []localModel
+	err := filepath.WalkDir(manifestsDir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !entry.Type().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(manifestsDir, path)
+		if err != nil {
+			return err
+		}
+		buf, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		model := localModel{Name: modelNameFromManifestPath(rel), ManifestPath: rel}
+		if err = json.Unmarshal(buf, &model.Manifest); err != nil {
+			log.Printf("Ignoring invalid manifest %s: %s", path, err)
+			return nil
+		}
+		models = append(models, model)
+		return nil
+	})
+	return models, err
+}
+
+// Convert a manifest path (host/namespace/model/tag) into a model name, as
+// displayed by ollama.
+func modelNameFromManifestPath(rel string) string {
+	parts := strings.Split(filepath.ToSlash(rel), "/")
+	if len(parts) != 4 {
+		return filepath.ToSlash(rel)
+	}
+	name := strings.Join(parts[:3], "/")
+	if parts[0] == defaultModelRegistry && parts[1] == defaultModelNamespace {
+		name = parts[2]
+	}
+	return name + ":" + parts[3]
+}
+
+// Get the path of the blob with the given digest in a models directory.
+func blobPath(modelsDir, digest string) (string, error) {
+	algorithm, hexDigest, ok := strings.Cut(digest, ":")
+	if !ok || algorithm != "sha256" || len(hexDigest) != sha256.Size*2 {
+		return "", fmt.Errorf("unsupported digest %q", digest)
+	}
+	if _, err := hex.DecodeString(hexDigest); err != nil {
+		return "", fmt.Errorf("invalid digest %q", digest)
+	}
+	return filepath.Join(modelsDir, "blobs", algorithm+"-"+hexDigest), nil
+}
+
+// Check that the file at the given path has the expected digest.
+func verifyBlob(ctx context.Context, path, digest string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	hasher := sha256.New()
+	if _, err = io.Copy(hasher, contextReader{ctx, file}); err != nil {
+		return fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	if actual := "sha256:" + hex.EncodeToString(hasher.Sum(nil)); actual != digest {
+		return fmt.Errorf("%s has digest %s, expected %s", path, actual, digest)
+	}
+	return nil
+}
+
+// How a blob was transferred.
+const (
+	blobLinked   = "linked"
+	blobCopied   = "copied"
+	blobExisting = "existing"
+)
+
+// modelsTransfer is the report of transferring models between directories.
+type modelsTransfer struct {
+	From   string         `json:"from"`
+	To     string         `json:"to"`
+	Models []string       `json:"models"`
+	Blobs  map[string]int `json:"blobs"`  // Number of blobs by how they were transferred.
+	Copied int64          `json:"copied"` // Bytes copied.
+}
+
+// Transfer all models from one ollama models directory to another.  Blobs are
+// hard linked where possible, and copied otherwise; all blobs are verified
+// against their digests.
+func transferModels(ctx context.Context, from, to string) (*modelsTransfer, error) {
+	models, err := listLocalModels(from)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list models in %s: %w", from, err)
+	}
+	report := &modelsTransfer{From: from, To: to, Models: []string{}, Blobs: map[string]int{}}
+	if err = os.MkdirAll(filepath.Join(to, "blobs"), 0o700); err != nil {
+		return nil, fmt.Errorf("failed to create models directory: %w", err)
+	}
+
+	for _, model := range models {
+		log.Printf("Transferring %s from %s to %s...", model.Name, from, to)
+		for _, layer := range append([]modelLayer{model.Manifest.Config}, model.Manifest.Layers...) {
+			if err = ctx.Err(); err != nil {
+				return report, err
+			}
+			method, copied, err := transferBlob(ctx, from, to, layer.Digest)
+			if err != nil {
+				return report, fmt.Errorf("failed to transfer %s: %w", model.Name, err)
+			}
+			report.Blobs[method]++
+			report.Copied += copied
+		}
+		// Write the manifest last, so that ollama never sees a model with
+		// missing blobs.
+		buf, err := os.ReadFile(filepath.Join(from, "manifests", model.ManifestPath))
+		if err != nil {
+			return report, fmt.Errorf("failed to read manifest for %s: %w", model.Name, err)
+		}
+		manifestPath := filepath.Join(to, "manifests", model.ManifestPath)
+		if err = os.MkdirAll(filepath.Dir(manifestPath), 0o700); err != nil {
+			return report, fmt.Errorf("failed to create manifest directory: %w", err)
+		}
+		if err = os.WriteFile(manifestPath, buf, 0o644); err != nil {
+			return report, fmt.Errorf("failed to write manifest for %s: %w", model.Name, err)
+		}
+		report.Models = append(report.Models, model.Name)
+	}
+	return report, nil
+}
+
+// Transfer a single blob, returning how it was transferred and how many bytes
+// were copied.
+func transferBlob(ctx context.Context, from, to, digest string) (string, int64, error) {
+	src, err := blobPath(from, digest)
+	if err != nil {
+		return "", 0, err
+	}
+	dst, err := blobPath(to, digest)
+	if err != nil {
+		return "", 0, err
+	}
+
+	if dstInfo, err := os.Stat(dst); err == nil {
+		if srcInfo, err := os.Stat(src); err == nil && os.SameFile(srcInfo, dstInfo) {
+			return blobExisting, 0, nil
+		}
+		if err = verifyBlob(ctx, dst, digest); err == nil {
+			return blobExisting, 0, nil
+		} else if ctx.Err() != nil {
+			return "", 0, ctx.Err()
+		}
+		log.Printf("Replacing corrupt blob %s: %s", dst, err)
+		if err = os.Remove(dst); err != nil {
+			return "", 0, err
+		}
+	}
+
+	if err = verifyBlob(ctx, src, digest); err != nil {
+		return "", 0, err
+	}
+	if err = os.Link(src, dst); err == nil {
+		return blobLinked, 0, nil
+	}
+
+	// Hard links are not possible (e.g. across file systems); copy instead,
+	// verifying the copy as we go.
+	copied, err := copyBlob(ctx, src, dst, digest)
+	if err != nil {
+		return "", 0, err
+	}
+	return blobCopied, copied, nil
+}
+
+// Copy a blob, checking that the data written matches the digest.  The
+// destination only appears once the copy is complete; if it fails or is
+// cancelled, the partial copy is removed.
+func copyBlob(ctx context.Context, src, dst, digest string) (int64, error) {
+	in, err := os.Open(src)
+	if err != nil {
+		return 0, err
+	}
+	defer in.Close()
+	tempPath := dst + ".partial"
+	out, err := os.OpenFile(tempPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o644)
+	if err != nil {
+		return 0, err
+	}
+	succeeded := false
+	defer func() {
+		if !succeeded {
+			out.Close()
+			_ = os.Remove(tempPath)
+		}
+	}()
+	hasher := sha256.New()
+	n, err := io.Copy(io.MultiWriter(out, hasher), contextReader{ctx, in})
+	if err != nil {
+		return 0, fmt.Errorf("failed to copy %s: %w", src, err)
+	}
+	if actual := "sha256:" + hex.EncodeToString(hasher.Sum(nil)); actual != digest {
+		return 0, fmt.Errorf("copy of %s has digest %s, expected %s", src, actual, digest)
+	}
+	if err = out.Close(); err != nil {
+		return 0, fmt.Errorf("failed to write %s: %w", tempPath, err)
+	}
+	if err = os.Rename(tempPath, dst); err != nil {
+		return 0, err
+	}
+	succeeded = true
+	return n, nil
+}
+
+// Get the external models directory to operate on: the -from flag if given,
+// or else the first detected one.
+func getModelsSource(ctx context.Context) (string, error) {
+	if modelsSource != "" {
+		return modelsSource, nil
+	}
+	detected, err := detectExternalModels(ctx)
+	if err != nil {
+		return "", err
+	}
+	for _, entry := range detected {
+		if !entry.Shared && len(entry.Models) > 0 {
+			return entry.Path, nil
+		}
+	}
+	return "", fmt.Errorf("no external ollama models were found; use -from to specify a directory")
+}
+
+// Print the external models directories found, as JSON.
+func printExternalModels(ctx context.Context) error {
+	detected, err := detectExternalModels(ctx)
+	if err != nil {
+		return err
+	}
+	if detected == nil {
+		detected = []externalModels{}
+	}
+	if err = json.NewEncoder(os.Stdout).Encode(detected); err != nil {
+		return fmt.Errorf("failed to output models: %w", err)
+	}
+	return nil
+}
+
+// Import models from an external install into the managed models directory.
+func importModels(ctx context.Context) error {
+	if isRemoteBackend() {
+		return errRemoteBackend("import models")
+	}
+	from, err := getModelsSource(ctx)
+	if err != nil {
+		return err
+	}
+	to, err := getModelsLocation(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to find models directory: %w", err)
+	}
+	if filepath.Clean(from) == filepath.Clean(to) {
+		return fmt.Errorf("%s is already the models directory", from)
+	}
+	report, err := transferModels(ctx, from, to)
+	if report != nil {
+		if encodeErr := json.NewEncoder(os.Stdout).Encode(report); encodeErr != nil && err == nil {
+			err = fmt.Errorf("failed to output import report: %w", encodeErr)
+		}
+	}
+	return err
+}
+
+// Configure the managed server to use the models directory of an external
+// install directly, by recording it in the per-user config file.  The server
+// must be restarted (see ModeApply) for this to take effect.
+func shareModels(ctx context.Context) error {
+	if isRemoteBackend() {
+		return errRemoteBackend("share models")
+	}
+	from, err := getModelsSource(ctx)
+	if err != nil {
+		return err
+	}
+	from, err = filepath.Abs(from)
+	if err != nil {
+		return err
+	}
+	if _, err = listLocalModels(from); err != nil {
+		return fmt.Errorf("%s does not look like an ollama models directory: %w", from, err)
+	}
+	if err = updateUserConfig(func(values map[string]any) {
+		paths, _ := values["paths"].(map[string]any)
+		if paths == nil {
+			paths = make(map[string]any)
+		}
+		paths["models"] = from
+		// Record that the directory is shared, so that it is never deleted.
+		paths["sharedModels"] = from
+		values["paths"] = paths
+	}); err != nil {
+		return err
+	}
+	log.Printf("Configured the managed server to use models from %s; restart it with \"installer config apply\".", from)
+	return nil
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+var skipPreflight bool
+
+// Register the flags controlling the preflight checks on install.
+func preflightFlags(flags *flag.FlagSet) {
+	flags.BoolVar(&skipPreflight, "skip-preflight", false, "install even if preflight checks find blocking problems")
+}
+
+// Severity of a preflight finding.
+const (
+	preflightBlocking = "blocking" // The install will fail.
+	preflightWarning  = "warning"  // The install may not work as expected.
+)
+
+// preflightFinding is a single problem found by the preflight checks.
+type preflightFinding struct {
+	Check    string `json:"check"`
+	Severity string `json:"severity"`
+	Message  string `json:"message"`
+}
+
+// preflightReport is the result of the preflight checks, as printed by
+// ModePreflight.
+type preflightReport struct {
+	Passed   bool               `json:"passed"` // No blocking findings.
+	Findings []preflightFinding `json:"findings"`
+}
+
+func (r *preflightReport) add(check, severity, format string, args ...any) {
+	r.Findings = append(r.Findings, preflightFinding{
+		Check:    check,
+		Severity: severity,
+		Message:  fmt.Sprintf(format, args...),
+	})
+}
+
+// Log a line for each finding in the report.
+func (r *preflightReport) log() {
+	for _, f := range r.Findings {
+		log.Printf("Preflight %s (%s): %s", f.Check, f.Severity, f.Message)
+	}
+}
+
+// Get an error describing the blocking findings, if any.
+func (r *preflightReport) err() error {
+	var messages []string
+	for _, f := range r.Findings {
+		if f.Severity == preflightBlocking {
+			messages = append(messages, f.Message)
+		}
+	}
+	if len(messages) == 0 {
+		return nil
+	}
+	return fmt.Errorf("preflight checks failed: %s", strings.Join(messages, "; "))
+}
+
+// Check whether ollama can be installed and run on this machine.
+func runPreflight(ctx context.Context) (*preflightReport, error) {
+	report := &preflightReport{Findings: []preflightFinding{}}
+	installDir, err := getDefaultInstallLocation(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get install location: %w", err)
+	}
+	// The install directory may not exist yet; check the file system it will
+	// be created on.
+	existingDir, err := nearestExistingDir(installDir)
+	if err != nil {
+		report.add("install-dir", preflightBlocking, "cannot access %s: %s", installDir, err)
+	} else {
+		checkWritable(report, existingDir)
+		checkDiskSpace(ctx, report, existingDir)
+		report.Findings = append(report.Findings, platformPreflightChecks(ctx, existingDir)...)
+	}
+	checkPorts(ctx, report)
+	report.Passed = report.err() == nil
+	return report, nil
+}
+
+// Find the closest ancestor of the path (including itself) that exists.
+func nearestExistingDir(path string) (string, error) {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+	for {
+		info, err := os.Stat(path)
+		if err == nil {
+			if !info.IsDir() {
+				return "", fmt.Errorf("%s is not a directory", path)
+			}
+			return path, nil
+		}
+		if !errors.Is(err, os.ErrNotExist) {
+			return "", err
+		}
+		parent := filepath.Dir(path)
+		if parent == path {
+			return "", err
+		}
+		path = parent
+	}
+}
+
+// Check that files can be created in the directory.
+func checkWritable(report *preflightReport, dir string) {
+	file, err := os.CreateTemp(dir, ".preflight-*")
+	if err != nil {
+		report.add("writable", preflightBlocking, "cannot write to %s: %s", dir, err)
+		return
+	}
+	file.Close()
+	_ = os.Remove(file.Name())
+}
+
+// Check that there is enough free space for the extracted release asset.
+func checkDiskSpace(ctx context.Context, report *preflightReport, dir string) {
+	free, err := getFreeSpace(dir)
+	if err != nil {
+		report.add("disk-space", preflightWarning, "failed to get free space for %s: %s", dir, err)
+		return
+	}
+	size, err := getReleaseAssetSize(ctx, config.Release, getOllamaAssetName())
+	if err != nil {
+		report.add("disk-space", preflightWarning, "failed to get download size: %s", err)
+		return
+	}
+	needed := uint64(size) * ollamaAssetExpansion
+	if free < needed {
+		report.add("disk-space", preflightBlocking, "%s has %d bytes free, but about %d bytes are needed", dir, free, needed)
+	}
+}
+
+// Get the size of a release asset, without downloading it.
+func getReleaseAssetSize(ctx context.Context, release, assetName string) (int64, error) {
+	asset, err := getReleaseAsset(ctx, release, assetName)
+	if err != nil {
+		return 0, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, asset.URL, nil)
+	if err != nil {
+		return 0, fmt.Errorf("failed to create request: %w", err)
+	}
+	resp, err := doWithRetry(ctx, req, remoteRetryPolicy)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get asset size: %w", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return 0, fmt.Errorf("failed to get asset size: unexpected status %s", resp.Status)
+	}
+	if resp.ContentLength <= 0 {
+		return 0, fmt.Errorf("failed to get asset size: no content length")
+	}
+	return resp.ContentLength, nil
+}
+
+// Check that the ports we use are free.  The ollama port is required for the
+// server to start; the others are published by the extension containers, so
+// may already be in use by a running copy of the extension.
+func checkPorts(ctx context.Context, report *preflightReport) {
+	ports := []struct {
+		name     string
+		port     int
+		severity string
+	}{
+		{"ollama", config.Ports.Ollama, preflightBlocking},
+		{"open-webui", openWebUIPort, preflightWarning},
+		{"searxng", searxngPort, preflightWarning},
+	}
+	for _, p := range ports {
+		listener, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", p.port))
+		if err == nil {
+			listener.Close()
+			continue
+		}
+		if p.name == "ollama" {
+			if pidFile, err := readPIDFile(ctx); err == nil && pidFile != nil && isOwnedServerRunning(pidFile) {
+				// Our own server is already using it.
+				continue
+			}
+		}
+		report.add("port", p.severity, "port %d (%s) is not available: %s", p.port, p.name, err)
+	}
+}
+
+// Compare two dotted numeric versions (such as "2.28"), returning -1, 0 or 1.
+// Non-numeric components compare as zero.
+func compareVersions(a, b string) int {
+	aParts, bParts := strings.Split(a, "."), strings.Split(b, ".")
+	for i := 0; i < len(aParts) || i < len(bParts); i++ {
+		var aNum, bNum int
+		if i < len(aParts) {
+			aNum, _ = strconv.Atoi(aParts[i])
+		}
+		if i < len(bParts) {
+			bNum, _ = strconv.Atoi(bParts[i])
+		}
+		if aNum != bNum {
+			if aNum < bNum {
+				return -1
+			}
+			return 1
+		}
+	}
+	return 0
+}
+
+// Run the preflight checks, printing the report as JSON; fails if there are
+// blocking findings.
+func printPreflight(ctx context.Context) error {
+	report, err := runPreflight(ctx)
+	if err != nil {
+		return err
+	}
+	if err = json.NewEncoder(os.Stdout).Encode(report); err != nil {
+		return fmt.Errorf("failed to output preflight report: %w", err)
+	}
+	return report.err()
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"time"
+)
+
+const (
+	// How often to check whether processes have exited.
+	processPollInterval = 100 * time.Millisecond
+	// How long to wait for processes to go away after killing them.
+	killWaitTimeout = 5 * time.Second
+)
+
+// processInfo describes a running process.
+type processInfo struct {
+	PID        int
+	PPID       int
+	Executable string
+	// StartTime is when the process started, in platform-specific units; it is
+	// used to detect PID reuse.
+	StartTime uint64
+	// exeInfo is the file info of the process executable, if available; this
+	// is used to match processes against an executable.
+	exeInfo os.FileInfo
+}
+
+// How a process was stopped.
+const (
+	stopMethodTerminated = "terminated" // Exited after a graceful request.
+	stopMethodExited     = "exited"     // Exited on its own (e.g. with its parent).
+	stopMethodKilled     = "killed"     // Forcibly killed after the grace period.
+	stopMethodFailed     = "failed"     // Still running.
+)
+
+// errNoGracefulStop is returned by terminatePID on platforms where a process
+// cannot be asked to exit, so that it is killed straight away.
+var errNoGracefulStop = errors.New("processes cannot be asked to exit on this platform")
+
+// stoppedProcess records how a single process was stopped.
+type stoppedProcess struct {
+	PID        int    `json:"pid"`
+	PPID       int    `json:"ppid"`
+	Executable string `json:"executable"`
+	Method     string `json:"method"`
+	Error      string `json:"error,omitempty"`
+}
+
+// shutdownReport describes the processes stopped by terminateProcess.
+type shutdownReport struct {
+	Processes []stoppedProcess `json:"processes"`
+}
+
+// Log a line for each process in the report.
+func (r *shutdownReport) log() {
+	for _, p := range r.Processes {
+		if p.Error != "" {
+			log.Printf("Process %d (%s): %s: %s", p.PID, p.Executable, p.Method, p.Error)
+		} else {
+			log.Printf("Process %d (%s): %s", p.PID, p.Executable, p.Method)
+		}
+	}
+}
+
+// terminateProcess stops all processes running the given executable, as well as
+// any of their descendants (such as model runners).  Processes are first asked
+// to exit, and are killed if they are still running after the grace period (or
+// straight away, where they cannot be asked to exit).
+func terminateProcess(ctx context.Context, executablePath string) (*shutdownReport, error) {
+	executableInfo, err := os.Stat(executablePath)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return &shutdownReport{}, nil
+		}
+		return nil, fmt.Errorf("failed to get executable info: %w", err)
+	}
+
+	procs, err := listProcesses()
+	if err != nil {
+		return nil, fmt.Errorf("error listing processes: %w", err)
+	}
+	var roots []processInfo
+	for _, proc := range procs {
+		if proc.exeInfo != nil && os.SameFile(executableInfo, proc.exeInfo) {
+			roots = append(roots, proc)
+		}
+	}
+
+	return stopProcesses(ctx, roots, processDescendants(procs, roots), gracePeriod), nil
+}
+
+// terminateOwnedProcess stops the ollama server recorded in the PID file, if it
+// is still running, along with its descendants.
+func terminateOwnedProcess(ctx context.Context) (*shutdownReport, error) {
+	pidFile, err := readPIDFile(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if pidFile == nil {
+		log.Printf("No PID file found; ollama was not started by the extension.")
+		return &shutdownReport{}, nil
+	}
+
+	procs, err := listProcesses()
+	if err != nil {
+		return nil, fmt.Errorf("error listing processes: %w", err)
+	}
+	for _, proc := range procs {
+		if proc.PID != pidFile.PID {
+			continue
+		}
+		if proc.StartTime != pidFile.StartTime {
+			log.Printf("Process %d was started after the recorded ollama server; ignoring stale PID file.", proc.PID)
+			break
+		}
+		roots := []processInfo{proc}
+		return stopProcesses(ctx, roots, processDescendants(procs, roots), gracePeriod), nil
+	}
+
+	return &shutdownReport{}, nil
+}
+
+// processDescendants returns all descendants of the given processes.
+func processDescendants(procs, roots []processInfo) []processInfo {
+	children := make(map[int][]processInfo)
+	for _, proc := range procs {
+		if proc.PPID != proc.PID {
+			children[proc.PPID] = append(children[proc.PPID], proc)
+		}
+	}
+	seen := make(map[int]bool)
+	for _, root := range roots {
+		seen[root.PID] = true
+	}
+	var result []processInfo
+	queue := append([]processInfo(nil), roots...)
+	for len(queue) > 0 {
+		proc := queue[0]
+		queue = queue[1:]
+		for _, child := range children[proc.PID] {
+			if seen[child.PID] {
+				continue
+			}
+			seen[child.PID] = true
+			result = append(result, child)
+			queue = append(queue, child)
+		}
+	}
+	return result
+}
+
+// stopProcesses asks the root processes to exit, waits up to the grace period
+// for them and their descendants to do so, and then kills any stragglers.
+func stopProcesses(ctx context.Context, roots, descendants []processInfo, grace time.Duration) *shutdownReport {
+	report := &shutdownReport{}
+	entries := make(map[int]*stoppedProcess)
+	var pending []int
+	for _, proc := range append(append([]processInfo(nil), roots...), descendants...) {
+		report.Processes = append(report.Processes, stoppedProcess{
+			PID:        proc.PID,
+			PPID:       proc.PPID,
+			Executable: proc.Executable,
+			Method:     stopMethodExited,
+		})
+	}
+	for i := range report.Processes {
+		entries[report.Processes[i].PID] = &report.Processes[i]
+		pending = append(pending, report.Processes[i].PID)
+	}
+
+	// Only the root processes are asked to exit; ollama stops its own runners.
+	for _, proc := range roots {
+		entries[proc.PID].Method = stopMethodTerminated
+		err := terminatePID(proc.PID)
+		if errors.Is(err, errNoGracefulStop) {
+			entries[proc.PID].Method = stopMethodKilled
+			if err = killPID(proc.PID); err != nil && !errors.Is(err, os.ErrProcessDone) {
+				entries[proc.PID].Error = err.Error()
+			}
+			continue
+		}
+		if err != nil && !errors.Is(err, os.ErrProcessDone) {
+			log.Printf("Failed to terminate pid %d: %s", proc.PID, err)
+		}
+	}
+
+	pending = waitForExit(ctx, pending, grace)
+	if len(pending) == 0 {
+		return report
+	}
+
+	for _, pid := range pending {
+		log.Printf("Process %d did not exit within %s; killing it", pid, grace)
+		entries[pid].Method = stopMethodKilled
+		if err := killPID(pid); err != nil && !errors.Is(err, os.ErrProcessDone) {
+			entries[pid].Error = err.Error()
+		}
+	}
+
+	for _, pid := range waitForExit(ctx, pending, killWaitTimeout) {
+		entries[pid].Method = stopMethodFailed
+		if entries[pid].Error == "" {
+			entries[pid].Error = "process is still running"
+		}
+	}
+
+	return report
+}
+
+// waitForExit waits up to the timeout for the given processes to exit, and
+// returns the ones that are still running.
+func waitForExit(ctx context.Context, pids []int, timeout time.Duration) []int {
+	deadline := time.Now().Add(timeout)
+	for {
+		var running []int
+		for _, pid := range pids {
+			if isProcessRunning(pid) {
+				running = append(running, pid)
+			}
+		}
+		if len(running) == 0 || time.Now().After(deadline) {
+			return running
+		}
+		pids = running
+		select {
+		case <-ctx.Done():
+			return running
+		case <-time.After(processPollInterval):
+		}
+	}
+}
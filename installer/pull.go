@@ -0,0 +1,308 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	pullStateFileName = "pull.json"
+	pullLogName       = "pull.log"
+	// How often to record progress while pulling.
+	pullStateInterval = 500 * time.Millisecond
+)
+
+// Status of a background model pull.
+const (
+	pullStatusPending   = "pending"
+	pullStatusRunning   = "running"
+	pullStatusSucceeded = "succeeded"
+	pullStatusFailed    = "failed"
+	pullStatusCancelled = "cancelled"
+)
+
+// pullState is the progress of a background model pull, as recorded in the
+// state directory and printed by ModePullStatus.
+type pullState struct {
+	Model     string    `json:"model"`
+	Status    string    `json:"status"`
+	Detail    string    `json:"detail,omitempty"` // Last status message from ollama.
+	Completed int64     `json:"completed"`        // Bytes downloaded.
+	Total     int64     `json:"total"`            // Total bytes, if known.
+	Error     string    `json:"error,omitempty"`
+	PID       int       `json:"pid,omitempty"`
+	StartTime uint64    `json:"startTime,omitempty"` // Of the pulling process; see processInfo.
+	Started   time.Time `json:"started"`
+	Updated   time.Time `json:"updated"`
+}
+
+// pullProgress is a single line of the streamed /api/pull response.
+type pullProgress struct {
+	Status    string `json:"status"`
+	Digest    string `json:"digest"`
+	Total     int64  `json:"total"`
+	Completed int64  `json:"completed"`
+	Error     string `json:"error"`
+}
+
+func getPullStatePath(ctx context.Context) (string, error) {
+	stateDir, err := getStateLocation(ctx)
+	if err != nil {
+		return "", fmt.Errorf("failed to find state directory: %w", err)
+	}
+	return filepath.Join(stateDir, pullStateFileName), nil
+}
+
+// Read the state of the background pull; returns nil if no pull has been
+// started.  If the pull claims to be in progress but its process is gone, it is
+// reported as failed.
+func readPullState(ctx context.Context) (*pullState, error) {
+	statePath, err := getPullStatePath(ctx)
+	if err != nil {
+		return nil, err
+	}
+	buf, err := os.ReadFile(statePath)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to read pull state: %w", err)
+	}
+	var state pullState
+	if err = json.Unmarshal(buf, &state); err != nil {
+		return nil, fmt.Errorf("failed to parse pull state: %w", err)
+	}
+	if state.inProgress() && !state.isProcessAlive() {
+		state.Status = pullStatusFailed
+		state.Error = "model pull exited unexpectedly"
+	}
+	return &state, nil
+}
+
+// Whether the pull has been started and has not yet finished.
+func (s *pullState) inProgress() bool {
+	return s.Status == pullStatusPending || s.Status == pullStatusRunning
+}
+
+// Whether the process recorded in the state is still running.
+func (s *pullState) isProcessAlive() bool {
+	if s.PID == 0 {
+		return false
+	}
+	startTime, err := getProcessStartTime(s.PID)
+	return err == nil && startTime == s.StartTime && isProcessRunning(s.PID)
+}
+
+// Write the state of the background pull.  The file is replaced atomically so
+// that readers never see a partial write.
+func writePullState(ctx context.Context, state *pullState) error {
+	statePath, err := getPullStatePath(ctx)
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(filepath.Dir(statePath), 0o755); err != nil {
+		return fmt.Errorf("failed to create state directory: %w", err)
+	}
+	state.Updated = time.Now().UTC()
+	buf, err := json.Marshal(state)
+	if err != nil {
+		return fmt.Errorf("failed to serialize pull state: %w", err)
+	}
+	tempPath := statePath + ".tmp"
+	if err = os.WriteFile(tempPath, buf, 0o644); err != nil {
+		return fmt.Errorf("failed to write pull state: %w", err)
+	}
+	if err = os.Rename(tempPath, statePath); err != nil {
+		return fmt.Errorf("failed to write pull state: %w", err)
+	}
+	return nil
+}
+
+// Start pulling the model in a detached installer process; this returns once
+// the process has been started.
+func startPullJob(ctx context.Context, models []string) error {
+	if state, err := readPullState(ctx); err == nil && state != nil && state.inProgress() {
+		log.Printf("Model pull for %s is already in progress (pid %d).", state.Model, state.PID)
+		return nil
+	}
+	state := &pullState{Model: models[0], Status: pullStatusPending, Started: time.Now().UTC()}
+	executable, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("failed to find executable path: %w", err)
+	}
+	args := []string{"models", "pull", "-model=" + strings.Join(models, ",")}
+	if state.PID, err = startDetachedProcess(ctx, pullLogName, nil, executable, args...); err != nil {
+		state.Status = pullStatusFailed
+		state.Error = err.Error()
+		_ = writePullState(ctx, state)
+		return fmt.Errorf("failed to start model pull: %w", err)
+	}
+	// The pull records its own state once it is running; don't overwrite it if
+	// it has already done so.
+	if current, err := readPullState(ctx); err == nil && current != nil && current.PID == state.PID {
+		return nil
+	}
+	if startTime, err := getProcessStartTime(state.PID); err == nil {
+		state.StartTime = startTime
+	}
+	return writePullState(ctx, state)
+}
+
+// Ask a running background pull to stop; returns its PID, or zero if no pull
+// was running.
+func cancelPullJob(ctx context.Context) (int, error) {
+	state, err := readPullState(ctx)
+	if err != nil || state == nil || !state.inProgress() {
+		return 0, err
+	}
+	log.Printf("Cancelling model pull for %s (pid %d)...", state.Model, state.PID)
+	if err = requestCancel(state.PID); err != nil {
+		return 0, fmt.Errorf("failed to cancel pid %d: %w", state.PID, err)
+	}
+	return state.PID, nil
+}
+
+// Pull the given models through the ollama server (which may be the remote
+// one), one at a time, recording progress in the pull state file.
+func pullModelsWithStatus(ctx context.Context, models []string) error {
+	if config.Backend == backendLlamaCpp {
+		return fmt.Errorf("the llama.cpp backend downloads llamaCpp.model when it starts; other models cannot be pulled")
+	}
+	if len(models) == 0 {
+		return fmt.Errorf("no model to pull")
+	}
+	// A pending pull is this process, if it was started by startPullJob.
+	if state, err := readPullState(ctx); err == nil && state != nil && state.inProgress() && state.PID != os.Getpid() {
+		return fmt.Errorf("a model pull for %s (pid %d) is already in progress", state.Model, state.PID)
+	}
+
+	state := &pullState{
+		Model:   models[0],
+		Status:  pullStatusRunning,
+		PID:     os.Getpid(),
+		Started: time.Now().UTC(),
+	}
+	if startTime, err := getProcessStartTime(state.PID); err == nil {
+		state.StartTime = startTime
+	}
+	if err := writePullState(ctx, state); err != nil {
+		return err
+	}
+
+	if rate, err := parseDownloadRate(config.Download); err == nil && rate.limited() {
+		// The server downloads the models itself.
+		log.Printf("Note: the download rate limit does not apply to model pulls.")
+	}
+	var err error
+	for _, model := range models {
+		state.Model, state.Completed, state.Total = model, 0, 0
+		err = pullModelFromServer(ctx, model, func(progress pullState) {
+			state.Detail, state.Completed, state.Total = progress.Detail, progress.Completed, progress.Total
+			if err := writePullState(ctx, state); err != nil {
+				log.Printf("Failed to record pull progress: %s", err)
+			}
+		})
+		if err != nil {
+			break
+		}
+	}
+	switch {
+	case err == nil:
+		state.Status = pullStatusSucceeded
+		state.Detail = ""
+	case errors.Is(err, context.Canceled):
+		state.Status = pullStatusCancelled
+	default:
+		state.Status = pullStatusFailed
+		state.Error = err.Error()
+	}
+	if writeErr := writePullState(ctx, state); writeErr != nil {
+		log.Printf("Failed to record pull result: %s", writeErr)
+	}
+	return err
+}
+
+// Pull the given model using the ollama API, calling report periodically with
+// the overall progress.
+func pullModelFromServer(ctx context.Context, model string, report func(pullState)) error {
+	body, err := json.Marshal(map[string]any{"model": model, "stream": true})
+	if err != nil {
+		return fmt.Errorf("failed to create pull request: %w", err)
+	}
+	req, err := newServerRequest(ctx, http.MethodPost, "/api/pull", bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to create pull request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	// Pulls are not idempotent requests, so are not retried here.
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to pull %s: %w", model, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("failed to pull %s: unexpected status %s", model, resp.Status)
+	}
+
+	log.Printf("Pulling %s...", model)
+	// Each layer is reported separately; sum them for the overall progress.
+	layers := make(map[string]pullProgress)
+	var lastReport time.Time
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		var progress pullProgress
+		if err = json.Unmarshal(scanner.Bytes(), &progress); err != nil {
+			return fmt.Errorf("failed to pull %s: unexpected response: %w", model, err)
+		}
+		if progress.Error != "" {
+			return fmt.Errorf("failed to pull %s: %s", model, progress.Error)
+		}
+		if progress.Status == "success" {
+			log.Printf("Pulled %s.", model)
+			return nil
+		}
+		if progress.Digest != "" {
+			layers[progress.Digest] = progress
+		}
+		if time.Since(lastReport) >= pullStateInterval {
+			overall := pullState{Detail: progress.Status}
+			for _, layer := range layers {
+				overall.Completed += layer.Completed
+				overall.Total += layer.Total
+			}
+			report(overall)
+			log.Printf("%s: %d/%d bytes", progress.Status, overall.Completed, overall.Total)
+			lastReport = time.Now()
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return fmt.Errorf("failed to pull %s: %w", model, err)
+	}
+	return fmt.Errorf("failed to pull %s: response ended unexpectedly", model)
+}
+
+// Print the state of the background model pull as JSON; if no pull has been
+// started, prints null.
+func printPullStatus(ctx context.Context) error {
+	state, err := readPullState(ctx)
+	if err != nil {
+		return err
+	}
+	if err = json.NewEncoder(os.Stdout).Encode(state); err != nil {
+		return fmt.Errorf("failed to output pull status: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// The most that is read at once from a rate limited reader, so that the
+	// limit is applied smoothly.
+	rateLimitReadSize = 32 * 1024
+	// At low limits, reads are made smaller so that each takes about this long
+	// at the limit; otherwise, waiting for a single read (or one on each of
+	// several connections) could exceed httpBodyIdleTimeout.
+	rateLimitReadInterval = time.Second
+	// The lowest rate each connection should get; fewer connections are used
+	// for downloads if the limit is too low to allow this.
+	minConnectionRate = 64 * 1024
+)
+
+// Unit suffixes for byte rates.
+var byteRateUnits = []struct {
+	suffix string
+	scale  float64
+}{
+	{"G", 1 << 30},
+	{"M", 1 << 20},
+	{"K", 1 << 10},
+	{"", 1},
+}
+
+// Parse a rate in bytes per second, such as "500K", "2M", "1.5MB/s" or
+// "1048576"; suffixes are powers of 1024.  Zero means no limit.
+func parseByteRate(s string) (int64, error) {
+	value := strings.TrimSuffix(strings.ToUpper(strings.TrimSpace(s)), "/S")
+	value = strings.TrimSuffix(value, "B")
+	for _, unit := range byteRateUnits {
+		if number, ok := strings.CutSuffix(value, unit.suffix); ok {
+			rate, err := strconv.ParseFloat(strings.TrimSpace(number), 64)
+			if err != nil || rate < 0 {
+				break
+			}
+			return int64(rate * unit.scale), nil
+		}
+	}
+	return 0, fmt.Errorf("invalid rate %q", s)
+}
+
+// Format a number of bytes for display, e.g. "1.5 MiB".
+func formatBytes(n int64) string {
+	for _, unit := range byteRateUnits[:3] {
+		if float64(n) >= unit.scale {
+			return fmt.Sprintf("%.1f %siB", float64(n)/unit.scale, unit.suffix)
+		}
+	}
+	return fmt.Sprintf("%d B", n)
+}
+
+// rateWindow is a time of day during which a different rate limit applies.
+type rateWindow struct {
+	start, end time.Duration // Since midnight, local time; may wrap around.
+	rate       int64
+}
+
+// Check if the window contains the given time of day.
+func (w rateWindow) contains(t time.Duration) bool {
+	if w.start <= w.end {
+		return t >= w.start && t < w.end
+	}
+	return t >= w.start || t < w.end
+}
+
+// downloadRate is the download rate limit, which may vary by time of day.
+type downloadRate struct {
+	base    int64 // Bytes per second outside of any window; zero for no limit.
+	windows []rateWindow
+}
+
+// Parse a time of day such as "09:00".
+func parseTimeOfDay(s string) (time.Duration, error) {
+	t, err := time.Parse("15:04", strings.TrimSpace(s))
+	if err != nil {
+		return 0, fmt.Errorf("invalid time of day %q", s)
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+// Parse the download rate settings.  Schedule entries have the form
+// "09:00-18:00=1M", and apply the given rate between the given local times of
+// day; the first matching entry wins.
+func parseDownloadRate(c downloadConfig) (*downloadRate, error) {
+	var result downloadRate
+	var err error
+	if c.RateLimit != "" {
+		if result.base, err = parseByteRate(c.RateLimit); err != nil {
+			return nil, fmt.Errorf("invalid download.rateLimit: %w", err)
+		}
+	}
+	for _, entry := range c.Schedule {
+		times, rate, ok := strings.Cut(entry, "=")
+		start, end, ok2 := strings.Cut(times, "-")
+		if !ok || !ok2 {
+			return nil, fmt.Errorf("invalid download.schedule entry %q: expected e.g. 09:00-18:00=1M", entry)
+		}
+		var window rateWindow
+		if window.start, err = parseTimeOfDay(start); err == nil {
+			if window.end, err = parseTimeOfDay(end); err == nil {
+				window.rate, err = parseByteRate(rate)
+			}
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid download.schedule entry %q: %w", entry, err)
+		}
+		result.windows = append(result.windows, window)
+	}
+	return &result, nil
+}
+
+// Check if any limit is configured.
+func (r *downloadRate) limited() bool {
+	if r.base > 0 {
+		return true
+	}
+	for _, window := range r.windows {
+		if window.rate > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// Get the lowest limit that may apply, in bytes per second; zero means there
+// is no limit at any time.
+func (r *downloadRate) lowest() int64 {
+	lowest := r.base
+	for _, window := range r.windows {
+		if window.rate > 0 && (lowest <= 0 || window.rate < lowest) {
+			lowest = window.rate
+		}
+	}
+	return lowest
+}
+
+// Get the rate limit at the given time, in bytes per second; zero means no
+// limit.
+func (r *downloadRate) at(t time.Time) int64 {
+	midnight := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	timeOfDay := t.Sub(midnight)
+	for _, window := range r.windows {
+		if window.contains(timeOfDay) {
+			return window.rate
+		}
+	}
+	return r.base
+}
+
+// Describe a rate limit for display.
+func describeRate(rate int64) string {
+	if rate <= 0 {
+		return "unlimited"
+	}
+	return formatBytes(rate) + "/s"
+}
+
+// rateLimiter limits the total rate of reads from any number of readers; a
+// nil limiter does not limit anything.
+type rateLimiter struct {
+	rate    *downloadRate
+	mu      sync.Mutex
+	next    time.Time // When the bytes read so far will have been paid for.
+	current int64     // The limit that was last applied, to log changes.
+}
+
+// Get a limiter for the configured download rate; returns nil if there is no
+// limit.
+func newDownloadRateLimiter() *rateLimiter {
+	rate, err := parseDownloadRate(config.Download)
+	if err != nil || !rate.limited() {
+		return nil // Validated when loading the config.
+	}
+	limiter := &rateLimiter{rate: rate, current: rate.at(time.Now())}
+	log.Printf("Download rate limited to %s.", describeRate(limiter.current))
+	return limiter
+}
+
+// Get the limit in effect now, in bytes per second.
+func (l *rateLimiter) limit() int64 {
+	if l == nil {
+		return 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.current
+}
+
+// Get the number of connections to download over, reducing the configured
+// number if the lowest limit would leave each with less than
+// minConnectionRate.
+func (l *rateLimiter) connections(configured int) int {
+	if l == nil {
+		return configured
+	}
+	lowest := l.rate.lowest()
+	if lowest <= 0 {
+		return configured
+	}
+	return max(1, min(configured, int(lowest/minConnectionRate)))
+}
+
+// Get how much to read at once at the current limit.
+func (l *rateLimiter) readSize() int {
+	limit := l.limit()
+	if limit <= 0 {
+		return rateLimitReadSize
+	}
+	return int(max(1, min(rateLimitReadSize, limit*int64(rateLimitReadInterval)/int64(time.Second))))
+}
+
+// Wait until reading n more bytes is within the limit.
+func (l *rateLimiter) wait(ctx context.Context, n int) error {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	now := time.Now()
+	rate := l.rate.at(now)
+	if rate != l.current {
+		log.Printf("Download rate limit changed to %s.", describeRate(rate))
+		l.current = rate
+	}
+	if rate <= 0 {
+		l.next = now
+		l.mu.Unlock()
+		return nil
+	}
+	if l.next.Before(now) {
+		l.next = now
+	}
+	l.next = l.next.Add(time.Duration(float64(n) / float64(rate) * float64(time.Second)))
+	delay := l.next.Sub(now)
+	l.mu.Unlock()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(delay):
+		return nil
+	}
+}
+
+// rateLimitedReader is a reader limited by a rateLimiter.
+type rateLimitedReader struct {
+	ctx     context.Context
+	r       io.Reader
+	limiter *rateLimiter
+}
+
+func (r *rateLimitedReader) Read(p []byte) (int, error) {
+	if size := r.limiter.readSize(); len(p) > size {
+		p = p[:size]
+	}
+	n, err := r.r.Read(p)
+	if n > 0 {
+		if waitErr := r.limiter.wait(r.ctx, n); waitErr != nil && err == nil {
+			err = waitErr
+		}
+	}
+	return n, err
+}
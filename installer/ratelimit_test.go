@@ -0,0 +1,176 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseByteRate(t *testing.T) {
+	tests := []struct {
+		input string
+		want  int64
+	}{
+		{"0", 0},
+		{"1048576", 1 << 20},
+		{"500K", 500 << 10},
+		{"500k", 500 << 10},
+		{"2M", 2 << 20},
+		{"1.5M", 3 << 19},
+		{"1.5MB/s", 3 << 19},
+		{"1G", 1 << 30},
+		{" 64 K ", 64 << 10},
+		{"100B", 100},
+	}
+	for _, test := range tests {
+		got, err := parseByteRate(test.input)
+		if err != nil {
+			t.Errorf("parseByteRate(%q) failed: %s", test.input, err)
+		} else if got != test.want {
+			t.Errorf("parseByteRate(%q) = %d, want %d", test.input, got, test.want)
+		}
+	}
+
+	for _, invalid := range []string{"", "fast", "-1M", "2T", "M", "1MM"} {
+		if _, err := parseByteRate(invalid); err == nil {
+			t.Errorf("expected an error parsing %q", invalid)
+		}
+	}
+}
+
+func TestParseDownloadRate(t *testing.T) {
+	tests := []struct {
+		name   string
+		config downloadConfig
+		want   downloadRate
+	}{
+		{name: "no limit", want: downloadRate{}},
+		{name: "base only", config: downloadConfig{RateLimit: "2M"}, want: downloadRate{base: 2 << 20}},
+		{
+			name:   "schedule",
+			config: downloadConfig{RateLimit: "2M", Schedule: []string{"09:00-18:00=1M", "22:30-06:15=0"}},
+			want: downloadRate{base: 2 << 20, windows: []rateWindow{
+				{start: 9 * time.Hour, end: 18 * time.Hour, rate: 1 << 20},
+				{start: 22*time.Hour + 30*time.Minute, end: 6*time.Hour + 15*time.Minute, rate: 0},
+			}},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := parseDownloadRate(test.config)
+			if err != nil {
+				t.Fatalf("failed to parse: %s", err)
+			}
+			if got.base != test.want.base || len(got.windows) != len(test.want.windows) {
+				t.Fatalf("got %+v, want %+v", *got, test.want)
+			}
+			for i := range got.windows {
+				if got.windows[i] != test.want.windows[i] {
+					t.Errorf("window %d is %+v, want %+v", i, got.windows[i], test.want.windows[i])
+				}
+			}
+		})
+	}
+
+	invalid := []downloadConfig{
+		{RateLimit: "fast"},
+		{Schedule: []string{"09:00-18:00"}},
+		{Schedule: []string{"09:00=1M"}},
+		{Schedule: []string{"9am-6pm=1M"}},
+		{Schedule: []string{"09:00-25:00=1M"}},
+		{Schedule: []string{"09:00-18:00=lots"}},
+	}
+	for _, c := range invalid {
+		if _, err := parseDownloadRate(c); err == nil {
+			t.Errorf("expected an error parsing %+v", c)
+		}
+	}
+}
+
+func TestRateWindowContains(t *testing.T) {
+	day := rateWindow{start: 9 * time.Hour, end: 18 * time.Hour}
+	night := rateWindow{start: 22 * time.Hour, end: 6 * time.Hour}
+	tests := []struct {
+		window rateWindow
+		at     time.Duration
+		want   bool
+	}{
+		{day, 9 * time.Hour, true},
+		{day, 12 * time.Hour, true},
+		{day, 18*time.Hour - time.Minute, true},
+		{day, 18 * time.Hour, false},
+		{day, 8*time.Hour + 59*time.Minute, false},
+		{day, 0, false},
+		{night, 22 * time.Hour, true},
+		{night, 23*time.Hour + 59*time.Minute, true},
+		{night, 0, true},
+		{night, 5*time.Hour + 59*time.Minute, true},
+		{night, 6 * time.Hour, false},
+		{night, 12 * time.Hour, false},
+		{night, 22*time.Hour - time.Minute, false},
+	}
+	for _, test := range tests {
+		if got := test.window.contains(test.at); got != test.want {
+			t.Errorf("%v-%v contains %v = %v, want %v", test.window.start, test.window.end, test.at, got, test.want)
+		}
+	}
+}
+
+func TestDownloadRateAt(t *testing.T) {
+	rate, err := parseDownloadRate(downloadConfig{
+		RateLimit: "2M",
+		Schedule:  []string{"09:00-18:00=1M", "17:00-23:00=512K", "23:00-07:00=0"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		hour, minute int
+		want         int64
+	}{
+		{8, 0, 2 << 20},
+		{9, 0, 1 << 20},
+		{17, 30, 1 << 20}, // The first matching window wins.
+		{18, 0, 512 << 10},
+		{23, 0, 0},
+		{2, 0, 0},
+		{7, 0, 2 << 20},
+	}
+	for _, test := range tests {
+		at := time.Date(2024, 3, 1, test.hour, test.minute, 0, 0, time.Local)
+		if got := rate.at(at); got != test.want {
+			t.Errorf("rate at %02d:%02d = %d, want %d", test.hour, test.minute, got, test.want)
+		}
+	}
+	if lowest := rate.lowest(); lowest != 512<<10 {
+		t.Errorf("lowest rate = %d, want %d", lowest, 512<<10)
+	}
+}
+
+func TestRateLimiterConnections(t *testing.T) {
+	tests := []struct {
+		config downloadConfig
+		want   int
+		read   int // Expected read size at the base rate; zero to skip the check.
+	}{
+		{downloadConfig{RateLimit: "10M"}, 4, rateLimitReadSize},
+		{downloadConfig{RateLimit: "128K"}, 2, rateLimitReadSize},
+		{downloadConfig{RateLimit: "16K"}, 1, 16 << 10},
+		{downloadConfig{RateLimit: "100B"}, 1, 100},
+		{downloadConfig{Schedule: []string{"09:00-18:00=1K"}}, 1, 0},
+	}
+	for _, test := range tests {
+		rate, err := parseDownloadRate(test.config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		limiter := &rateLimiter{rate: rate, current: rate.base}
+		if got := limiter.connections(4); got != test.want {
+			t.Errorf("connections for %+v = %d, want %d", test.config, got, test.want)
+		}
+		if test.read > 0 {
+			if got := limiter.readSize(); got != test.read {
+				t.Errorf("read size for %+v = %d, want %d", test.config, got, test.read)
+			}
+		}
+	}
+}
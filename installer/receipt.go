@@ -0,0 +1,333 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+)
+
+const receiptFileName = "install-receipt.json"
+
+// installReceipt records what was installed, for ModeVerify and ModeRepair.
+type installReceipt struct {
+	Release   string    `json:"release"`
+	Version   string    `json:"version"` // As reported by the executable.
+	AssetURL  string    `json:"assetURL"`
+	Digest    string    `json:"digest"` // Of the downloaded asset.
+	Installed time.Time `json:"installed"`
+	// Path is the install location; file names are relative to it.  On macOS
+	// this is the executable itself, recorded under the name ".".
+	Path  string                 `json:"path"`
+	Files map[string]receiptFile `json:"files"`
+}
+
+// receiptFile describes a single installed file.
+type receiptFile struct {
+	SHA256 string `json:"sha256,omitempty"` // For regular files.
+	Link   string `json:"link,omitempty"`   // For symbolic links, the target.
+}
+
+// Problems found with an installed file.
+const (
+	fileMissing  = "missing"
+	fileModified = "modified"
+)
+
+// damagedFile is an installed file that does not match the receipt.
+type damagedFile struct {
+	Name    string `json:"name"`
+	Problem string `json:"problem"`
+}
+
+// verifyReport is the output of ModeVerify and ModeRepair.
+type verifyReport struct {
+	Release  string        `json:"release"`
+	Path     string        `json:"path"`
+	Files    int           `json:"files"` // Number of files in the receipt.
+	OK       bool          `json:"ok"`
+	Damaged  []damagedFile `json:"damaged"`
+	Repaired []string      `json:"repaired,omitempty"`
+}
+
+func getReceiptPath(ctx context.Context) (string, error) {
+	stateDir, err := getStateLocation(ctx)
+	if err != nil {
+		return "", fmt.Errorf("failed to find state directory: %w", err)
+	}
+	return filepath.Join(stateDir, receiptFileName), nil
+}
+
+// Get the SHA-256 of a file, as a hex string.
+func hashFile(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	hasher := sha256.New()
+	if _, err = io.Copy(hasher, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
+
+// Describe the file at the given path for the receipt.
+func describeInstalledFile(path string) (receiptFile, error) {
+	info, err := os.Lstat(path)
+	if err != nil {
+		return receiptFile{}, err
+	}
+	if info.Mode()&fs.ModeSymlink != 0 {
+		target, err := os.Readlink(path)
+		return receiptFile{Link: target}, err
+	}
+	sum, err := hashFile(path)
+	return receiptFile{SHA256: sum}, err
+}
+
+// Record the files at the install location, along with the asset they were
+// installed from and the version of the executable.
+func writeInstallReceipt(ctx context.Context, installPath string, asset *assetInfo, version string) error {
+	receipt := installReceipt{
+		Release:   asset.Release,
+		Version:   version,
+		AssetURL:  asset.URL,
+		Digest:    asset.Digest,
+		Installed: time.Now().UTC(),
+		Path:      installPath,
+		Files:     make(map[string]receiptFile),
+	}
+	err := filepath.WalkDir(installPath, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(installPath, path)
+		if err != nil {
+			return err
+		}
+		file, err := describeInstalledFile(path)
+		if err != nil {
+			return err
+		}
+		receipt.Files[filepath.ToSlash(rel)] = file
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to record installed files: %w", err)
+	}
+
+	receiptPath, err := getReceiptPath(ctx)
+	if err != nil {
+		return err
+	}
+	buf, err := json.MarshalIndent(receipt, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to serialize install receipt: %w", err)
+	}
+	if err = os.MkdirAll(filepath.Dir(receiptPath), 0o755); err != nil {
+		return fmt.Errorf("failed to create state directory: %w", err)
+	}
+	if err = os.WriteFile(receiptPath, buf, 0o644); err != nil {
+		return fmt.Errorf("failed to write install receipt: %w", err)
+	}
+	log.Printf("Recorded %d installed files from %s.", len(receipt.Files), receipt.Release)
+	return nil
+}
+
+// Read the install receipt; returns nil if there is none.
+func readInstallReceipt(ctx context.Context) (*installReceipt, error) {
+	receiptPath, err := getReceiptPath(ctx)
+	if err != nil {
+		return nil, err
+	}
+	buf, err := os.ReadFile(receiptPath)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to read install receipt: %w", err)
+	}
+	var receipt installReceipt
+	if err = json.Unmarshal(buf, &receipt); err != nil {
+		return nil, fmt.Errorf("failed to parse install receipt: %w", err)
+	}
+	return &receipt, nil
+}
+
+// Compare the installed files against the receipt.
+func verifyInstalledFiles(ctx context.Context, receipt *installReceipt) (*verifyReport, error) {
+	report := &verifyReport{
+		Release: receipt.Release,
+		Path:    receipt.Path,
+		Files:   len(receipt.Files),
+		Damaged: []damagedFile{},
+	}
+	names := make([]string, 0, len(receipt.Files))
+	for name := range receipt.Files {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	for _, name := range names {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		actual, err := describeInstalledFile(filepath.Join(receipt.Path, filepath.FromSlash(name)))
+		if errors.Is(err, os.ErrNotExist) {
+			report.Damaged = append(report.Damaged, damagedFile{Name: name, Problem: fileMissing})
+			continue
+		} else if err != nil {
+			return nil, fmt.Errorf("failed to check %s: %w", name, err)
+		}
+		if actual != receipt.Files[name] {
+			report.Damaged = append(report.Damaged, damagedFile{Name: name, Problem: fileModified})
+		}
+	}
+	report.OK = len(report.Damaged) == 0
+	return report, nil
+}
+
+func printVerifyReport(report *verifyReport) error {
+	for _, file := range report.Damaged {
+		log.Printf("%s: %s", file.Name, file.Problem)
+	}
+	if err := json.NewEncoder(os.Stdout).Encode(report); err != nil {
+		return fmt.Errorf("failed to output verification report: %w", err)
+	}
+	return nil
+}
+
+// Check the installed files against the install receipt, printing the result
+// as JSON; fails if any files are damaged.
+func verifyInstall(ctx context.Context) error {
+	receipt, err := readInstallReceipt(ctx)
+	if err != nil {
+		return err
+	}
+	if receipt == nil {
+		return fmt.Errorf("no install receipt found; ollama was not installed by this installer")
+	}
+	report, err := verifyInstalledFiles(ctx, receipt)
+	if err != nil {
+		return err
+	}
+	if err = printVerifyReport(report); err != nil {
+		return err
+	}
+	if !report.OK {
+		return fmt.Errorf("%d installed files are damaged; run the repair command to restore them", len(report.Damaged))
+	}
+	return nil
+}
+
+// Restore damaged installed files by downloading the recorded release asset
+// again and extracting only those files.  The managed server is stopped while
+// the files are replaced, and restarted afterwards.
+func repairInstall(ctx context.Context) error {
+	if isRemoteBackend() {
+		return errRemoteBackend("repair ollama")
+	}
+	receipt, err := readInstallReceipt(ctx)
+	if err != nil {
+		return err
+	}
+	if receipt == nil {
+		return fmt.Errorf("no install receipt found; ollama was not installed by this installer")
+	}
+	report, err := verifyInstalledFiles(ctx, receipt)
+	if err != nil {
+		return err
+	}
+	if report.OK {
+		log.Printf("All %d installed files are intact.", report.Files)
+		return printVerifyReport(report)
+	}
+
+	damaged := make(map[string]bool)
+	for _, file := range report.Damaged {
+		damaged[filepath.FromSlash(file.Name)] = true
+	}
+
+	// The asset must match the one originally installed.
+	asset := &assetInfo{Name: filepath.Base(receipt.AssetURL), URL: receipt.AssetURL, Digest: receipt.Digest, Release: receipt.Release}
+	download, err := downloadAsset(ctx, asset)
+	if err != nil {
+		return err
+	}
+	defer download.Close()
+	// Keep the asset in the cache directory until it has been verified, so
+	// that only the expected files are restored.
+	cacheDir, err := getCacheLocation(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to find cache directory: %w", err)
+	}
+	if err = os.MkdirAll(cacheDir, 0o755); err != nil {
+		return fmt.Errorf("failed to create cache directory: %w", err)
+	}
+	assetFile, err := os.CreateTemp(cacheDir, asset.Name+".*")
+	if err != nil {
+		return fmt.Errorf("failed to create download file: %w", err)
+	}
+	defer os.Remove(assetFile.Name())
+	defer assetFile.Close()
+	if _, err = io.Copy(assetFile, download); err != nil {
+		return fmt.Errorf("failed to download ollama: %w", err)
+	}
+	if _, err = download.finish(); err != nil {
+		return fmt.Errorf("failed to repair ollama: %w", err)
+	}
+	if _, err = assetFile.Seek(0, io.SeekStart); err != nil {
+		return fmt.Errorf("failed to read download: %w", err)
+	}
+	pidFile, err := readPIDFile(ctx)
+	if err != nil {
+		return err
+	}
+	wasRunning := pidFile != nil && isOwnedServerRunning(pidFile)
+	if wasRunning {
+		log.Printf("Stopping the ollama server to repair it...")
+		shutdown, err := terminateOwnedProcess(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to stop ollama: %w", err)
+		}
+		shutdown.log()
+	}
+
+	if err = extractOllama(ctx, assetFile, receipt.Path, func(name string) bool { return damaged[name] }); err != nil {
+		return fmt.Errorf("failed to repair ollama: %w", err)
+	}
+
+	repaired, err := verifyInstalledFiles(ctx, receipt)
+	if err != nil {
+		return err
+	}
+	for _, file := range report.Damaged {
+		if !slices.ContainsFunc(repaired.Damaged, func(d damagedFile) bool { return d.Name == file.Name }) {
+			repaired.Repaired = append(repaired.Repaired, file.Name)
+		}
+	}
+	if err = printVerifyReport(repaired); err != nil {
+		return err
+	}
+	if !repaired.OK {
+		return fmt.Errorf("%d installed files could not be repaired", len(repaired.Damaged))
+	}
+	log.Printf("Repaired %d installed files.", len(repaired.Repaired))
+
+	if wasRunning {
+		executablePath := findExecutable(ctx, true)
+		if err = startServer(ctx, executablePath); err != nil {
+			return fmt.Errorf("failed to restart ollama: %w", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,399 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	ollamaReleasesURL = "https://api.github.com/repos/ollama/ollama/releases"
+	// How many releases to request per page, the most GitHub allows.
+	releasesPerPage = 100
+	// How many pages of releases to read at most; older releases are ignored.
+	maxReleasePages = 10
+)
+
+// Release channels that may be used instead of a tag or constraint.
+const (
+	releaseLatest     = "latest"     // The release GitHub marks as the latest.
+	releaseStable     = "stable"     // The newest release that is not a prerelease.
+	releasePrerelease = "prerelease" // The newest release, including prereleases.
+)
+
+// listedRelease is a release as returned by the GitHub releases list, which
+// includes its assets.
+type listedRelease struct {
+	releaseInfo
+	Name        string      `json:"name"`
+	Draft       bool        `json:"draft"`
+	Prerelease  bool        `json:"prerelease"`
+	PublishedAt time.Time   `json:"published_at"`
+	HTMLURL     string      `json:"html_url"`
+	Body        string      `json:"body"` // Release notes.
+	Assets      []assetInfo `json:"assets"`
+}
+
+// Find the asset with the given name in the release.
+func (r *listedRelease) asset(name string) *assetInfo {
+	for _, asset := range r.Assets {
+		if asset.Name == name {
+			asset.Release = r.TagName
+			return &asset
+		}
+	}
+	return nil
+}
+
+// Check if the release is a prerelease, either as marked on GitHub or by its
+// version.
+func (r *listedRelease) isPrerelease() bool {
+	version, ok := parseReleaseVersion(r.TagName)
+	return r.Prerelease || (ok && version.Pre != "")
+}
+
+// releaseVersion is a parsed semantic version; missing parts are -1, which is
+// only allowed in constraints.
+type releaseVersion struct {
+	Major, Minor, Patch int
+	Pre                 string // Prerelease identifiers, e.g. "rc1".
+}
+
+var releaseVersionPattern = regexp.MustCompile(`^v?(\d+)(?:\.(\d+))?(?:\.(\d+))?(?:-([0-9A-Za-z.-]+))?(?:\+[0-9A-Za-z.-]+)?$`)
+
+// Parse a version such as "v0.5.7", "0.6.0-rc1" or "0.5".
+func parseReleaseVersion(s string) (releaseVersion, bool) {
+	match := releaseVersionPattern.FindStringSubmatch(s)
+	if match == nil {
+		return releaseVersion{}, false
+	}
+	version := releaseVersion{Major: -1, Minor: -1, Patch: -1, Pre: match[4]}
+	for i, part := range []*int{&version.Major, &version.Minor, &version.Patch} {
+		if match[i+1] != "" {
+			*part, _ = strconv.Atoi(match[i+1])
+		}
+	}
+	if version.Pre != "" && version.Patch < 0 {
+		return releaseVersion{}, false
+	}
+	return version, true
+}
+
+// Compare two versions, returning -1, 0 or 1; missing parts compare as zero.
+// Prereleases sort before the release, as in semantic versioning.
+func (v releaseVersion) compare(other releaseVersion) int {
+	for _, pair := range [][2]int{{v.Major, other.Major}, {v.Minor, other.Minor}, {v.Patch, other.Patch}} {
+		a, b := max(pair[0], 0), max(pair[1], 0)
+		if a != b {
+			if a < b {
+				return -1
+			}
+			return 1
+		}
+	}
+	switch {
+	case v.Pre == other.Pre:
+		return 0
+	case v.Pre == "":
+		return 1
+	case other.Pre == "":
+		return -1
+	}
+	aParts, bParts := strings.Split(v.Pre, "."), strings.Split(other.Pre, ".")
+	for i := 0; i < len(aParts) && i < len(bParts); i++ {
+		if aParts[i] == bParts[i] {
+			continue
+		}
+		aNum, aErr := strconv.Atoi(aParts[i])
+		bNum, bErr := strconv.Atoi(bParts[i])
+		switch {
+		case aErr == nil && bErr == nil:
+			if aNum < bNum {
+				return -1
+			}
+			return 1
+		case aErr == nil:
+			return -1 // Numeric identifiers sort first.
+		case bErr == nil:
+			return 1
+		case aParts[i] < bParts[i]:
+			return -1
+		default:
+			return 1
+		}
+	}
+	// A longer set of identifiers sorts later if the rest are equal.
+	switch {
+	case len(aParts) < len(bParts):
+		return -1
+	case len(aParts) > len(bParts):
+		return 1
+	}
+	return 0
+}
+
+// Get the smallest version above every version matching this partial version,
+// e.g. 0.6.0 for 0.5, or 1.0.0 for 0.
+func (v releaseVersion) nextPartial() releaseVersion {
+	switch {
+	case v.Minor < 0:
+		return releaseVersion{Major: v.Major + 1}
+	case v.Patch < 0:
+		return releaseVersion{Major: v.Major, Minor: v.Minor + 1}
+	}
+	return releaseVersion{Major: v.Major, Minor: v.Minor, Patch: v.Patch + 1}
+}
+
+// versionComparison is a single comparison in a release constraint.
+type versionComparison struct {
+	op      string // One of "=", "<", "<=", ">" and ">=".
+	version releaseVersion
+}
+
+func (c versionComparison) matches(v releaseVersion) bool {
+	result := v.compare(c.version)
+	switch c.op {
+	case "<":
+		return result < 0
+	case "<=":
+		return result <= 0
+	case ">":
+		return result > 0
+	case ">=":
+		return result >= 0
+	}
+	return result == 0
+}
+
+// releaseConstraint is a set of comparisons that a version must all match.
+type releaseConstraint []versionComparison
+
+func (c releaseConstraint) matches(v releaseVersion) bool {
+	for _, comparison := range c {
+		if !comparison.matches(v) {
+			return false
+		}
+	}
+	return true
+}
+
+// Check if the release setting is a constraint (or channel), rather than an
+// exact tag or "latest".  A partial version such as "0.5" is a constraint
+// matching any 0.5.x, as there is no release tagged with it.
+func isReleaseConstraint(release string) bool {
+	if release == releaseStable || release == releasePrerelease || strings.ContainsAny(release, "~^<>=, ") {
+		return true
+	}
+	version, ok := parseReleaseVersion(release)
+	return ok && version.Patch < 0
+}
+
+// Parse a constraint made of space or comma separated terms, all of which
+// must match: a comparison such as ">=0.5.4" or "<0.6", a tilde range such as
+// "~0.5" (any 0.5.x) or "~0.5.4" (0.5.4 or later 0.5.x), a caret range such
+// as "^1.2" (any 1.x from 1.2), or a version, where a partial version such as
+// "0.5" matches any 0.5.x.
+func parseReleaseConstraint(s string) (releaseConstraint, error) {
+	var constraint releaseConstraint
+	terms := strings.FieldsFunc(s, func(r rune) bool { return r == ' ' || r == ',' })
+	if len(terms) == 0 {
+		return nil, fmt.Errorf("empty release constraint")
+	}
+	for _, term := range terms {
+		rest := strings.TrimLeft(term, "~^<>=")
+		op := term[:len(term)-len(rest)]
+		version, ok := parseReleaseVersion(rest)
+		if !ok {
+			return nil, fmt.Errorf("invalid version in release constraint %q", term)
+		}
+		lower := version
+		lower.Minor, lower.Patch = max(lower.Minor, 0), max(lower.Patch, 0)
+		switch op {
+		case "~":
+			upper := releaseVersion{Major: version.Major + 1}
+			if version.Minor >= 0 {
+				upper = releaseVersion{Major: version.Major, Minor: version.Minor + 1}
+			}
+			constraint = append(constraint, versionComparison{">=", lower}, versionComparison{"<", upper})
+		case "^":
+			// Changes to the leftmost non-zero part are incompatible.
+			upper := releaseVersion{Major: version.Major + 1}
+			if version.Major == 0 && version.Minor >= 0 {
+				upper = releaseVersion{Minor: version.Minor + 1}
+				if version.Minor == 0 && version.Patch >= 0 {
+					upper = releaseVersion{Patch: version.Patch + 1}
+				}
+			}
+			constraint = append(constraint, versionComparison{">=", lower}, versionComparison{"<", upper})
+		case "", "=", "==":
+			if version.Patch < 0 {
+				constraint = append(constraint, versionComparison{">=", lower}, versionComparison{"<", version.nextPartial()})
+			} else {
+				constraint = append(constraint, versionComparison{"=", version})
+			}
+		case "<", ">=":
+			constraint = append(constraint, versionComparison{op, lower})
+		case "<=", ">":
+			// "<=0.5" means up to any 0.5.x, and ">0.5" means from 0.6.0.
+			if version.Patch < 0 {
+				next := map[string]string{"<=": "<", ">": ">="}[op]
+				constraint = append(constraint, versionComparison{next, version.nextPartial()})
+			} else {
+				constraint = append(constraint, versionComparison{op, version})
+			}
+		default:
+			return nil, fmt.Errorf("invalid operator %q in release constraint %q", op, term)
+		}
+	}
+	return constraint, nil
+}
+
+// Get the URL of the next page from a GitHub Link header, if any.
+func nextPageURL(header string) string {
+	for _, link := range strings.Split(header, ",") {
+		target, params, ok := strings.Cut(strings.TrimSpace(link), ";")
+		if ok && strings.Contains(params, `rel="next"`) {
+			return strings.Trim(strings.TrimSpace(target), "<>")
+		}
+	}
+	return ""
+}
+
+// List the ollama releases, newest first, reading up to maxReleasePages pages.
+// Draft releases are skipped.
+func listReleases(ctx context.Context) ([]listedRelease, error) {
+	var releases []listedRelease
+	pageURL := fmt.Sprintf("%s?per_page=%d", ollamaReleasesURL, releasesPerPage)
+	for page := 0; pageURL != "" && page < maxReleasePages; page++ {
+		entry, err := fetchMetadata(ctx, pageURL)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list releases: %w", err)
+		}
+		var pageReleases []listedRelease
+		if err = json.Unmarshal(entry.Body, &pageReleases); err != nil {
+			return nil, fmt.Errorf("failed to list releases: error unmarshaling response: %w", err)
+		}
+		for _, release := range pageReleases {
+			if !release.Draft {
+				releases = append(releases, release)
+			}
+		}
+		pageURL = nextPageURL(entry.Link)
+	}
+	return releases, nil
+}
+
+// Select the newest release matching the release setting (a channel or
+// constraint) that has the given asset; "latest" is treated as "stable".
+// Constraints only match prereleases if they name a prerelease version.
+func selectRelease(releases []listedRelease, release, assetName string) (*listedRelease, error) {
+	var constraint releaseConstraint
+	allowPrerelease := release == releasePrerelease
+	if release != releaseStable && release != releasePrerelease && release != releaseLatest {
+		var err error
+		if constraint, err = parseReleaseConstraint(release); err != nil {
+			return nil, err
+		}
+		for _, comparison := range constraint {
+			allowPrerelease = allowPrerelease || comparison.version.Pre != ""
+		}
+	}
+	var selected *listedRelease
+	var selectedVersion releaseVersion
+	for i := range releases {
+		candidate := &releases[i]
+		version, ok := parseReleaseVersion(candidate.TagName)
+		if !ok || candidate.asset(assetName) == nil {
+			continue
+		}
+		if candidate.isPrerelease() && !allowPrerelease {
+			continue
+		}
+		if constraint != nil && !constraint.matches(version) {
+			continue
+		}
+		if selected == nil || version.compare(selectedVersion) > 0 {
+			selected, selectedVersion = candidate, version
+		}
+	}
+	if selected == nil {
+		return nil, fmt.Errorf("no release matching %q has asset %q", release, assetName)
+	}
+	return selected, nil
+}
+
+// Find the asset in the newest release matching the release setting, which
+// must be a channel or constraint.
+func findConstrainedReleaseAsset(ctx context.Context, release, assetName string) (*assetInfo, error) {
+	releases, err := listReleases(ctx)
+	if err != nil {
+		return nil, err
+	}
+	selected, err := selectRelease(releases, release, assetName)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Resolved release %q to %s.", release, selected.TagName)
+	return selected.asset(assetName), nil
+}
+
+// releaseListing is an entry in the output of ModeReleases.
+type releaseListing struct {
+	Tag        string    `json:"tag"`
+	Name       string    `json:"name"`
+	Published  time.Time `json:"published"`
+	Prerelease bool      `json:"prerelease"`
+	URL        string    `json:"url"`
+	Asset      string    `json:"asset"`
+	Size       int64     `json:"size"`
+	// Selected is set on the release that would be installed with the
+	// current release setting.
+	Selected bool `json:"selected"`
+}
+
+// Print the releases that have an asset for this machine as JSON, newest
+// first.
+func printReleases(ctx context.Context) error {
+	assetName := getOllamaAssetName()
+	releases, err := listReleases(ctx)
+	if err != nil {
+		return err
+	}
+	selectedTag := config.Release
+	if isReleaseConstraint(config.Release) || config.Release == releaseLatest {
+		// GitHub's latest release is normally the newest stable one.
+		if selected, err := selectRelease(releases, config.Release, assetName); err != nil {
+			log.Printf("Warning: %s", err)
+		} else {
+			selectedTag = selected.TagName
+		}
+	}
+
+	listing := []releaseListing{}
+	for _, release := range releases {
+		asset := release.asset(assetName)
+		if asset == nil {
+			continue
+		}
+		listing = append(listing, releaseListing{
+			Tag:        release.TagName,
+			Name:       release.Name,
+			Published:  release.PublishedAt,
+			Prerelease: release.isPrerelease(),
+			URL:        release.HTMLURL,
+			Asset:      asset.Name,
+			Size:       asset.Size,
+			Selected:   release.TagName == selectedTag,
+		})
+	}
+	if err = json.NewEncoder(os.Stdout).Encode(listing); err != nil {
+		return fmt.Errorf("failed to output releases: %w", err)
+	}
+	return nil
+}
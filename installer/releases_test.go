@@ -0,0 +1,143 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestIsReleaseConstraint(t *testing.T) {
+	tests := []struct {
+		release string
+		want    bool
+	}{
+		{"latest", false},
+		{"v0.5.7", false},
+		{"0.5.7", false},
+		{"v0.6.0-rc1", false},
+		{"stable", true},
+		{"prerelease", true},
+		{"0", true},
+		{"0.5", true},
+		{"v0.5", true},
+		{"~0.5", true},
+		{">=0.5.4 <0.6", true},
+		{"^1.2", true},
+	}
+	for _, test := range tests {
+		if got := isReleaseConstraint(test.release); got != test.want {
+			t.Errorf("isReleaseConstraint(%q) = %v, want %v", test.release, got, test.want)
+		}
+	}
+}
+
+func TestParseReleaseConstraint(t *testing.T) {
+	tests := []struct {
+		constraint string
+		matches    []string
+		rejects    []string
+	}{
+		{"0.5", []string{"0.5.0", "v0.5.7"}, []string{"0.4.9", "0.6.0"}},
+		{"0", []string{"0.0.1", "0.9.9"}, []string{"1.0.0"}},
+		{"0.5.4", []string{"0.5.4"}, []string{"0.5.5", "0.5.4-rc1"}},
+		{"=0.5.4", []string{"0.5.4"}, []string{"0.5.3"}},
+		{"~0.5", []string{"0.5.0", "0.5.9"}, []string{"0.6.0", "0.4.0"}},
+		{"~0.5.4", []string{"0.5.4", "0.5.9"}, []string{"0.5.3", "0.6.0"}},
+		{"~1", []string{"1.0.0", "1.9.0"}, []string{"2.0.0"}},
+		{"^1.2", []string{"1.2.0", "1.9.9"}, []string{"1.1.9", "2.0.0"}},
+		{"^0.5", []string{"0.5.0", "0.5.9"}, []string{"0.6.0"}},
+		{"^0.0.3", []string{"0.0.3"}, []string{"0.0.4"}},
+		{">=0.5.4 <0.6", []string{"0.5.4", "0.5.10"}, []string{"0.5.3", "0.6.0"}},
+		{">=0.5.4,<0.6", []string{"0.5.4"}, []string{"0.6.0"}},
+		{"<=0.5", []string{"0.5.9", "0.4.0"}, []string{"0.6.0"}},
+		{">0.5", []string{"0.6.0"}, []string{"0.5.9"}},
+		{">0.5.1", []string{"0.5.2"}, []string{"0.5.1"}},
+		{">=0.6.0-rc1", []string{"0.6.0-rc1", "0.6.0-rc2", "0.6.0"}, []string{"0.5.9", "0.6.0-beta"}},
+	}
+	for _, test := range tests {
+		constraint, err := parseReleaseConstraint(test.constraint)
+		if err != nil {
+			t.Errorf("failed to parse %q: %s", test.constraint, err)
+			continue
+		}
+		for _, s := range append(test.matches, test.rejects...) {
+			version, ok := parseReleaseVersion(s)
+			if !ok {
+				t.Fatalf("failed to parse version %q", s)
+			}
+			want := slices.Contains(test.matches, s)
+			if got := constraint.matches(version); got != want {
+				t.Errorf("%q matches %q = %v, want %v", test.constraint, s, got, want)
+			}
+		}
+	}
+
+	for _, invalid := range []string{"", " , ", "~", ">=x", "!=0.5", "0.5-rc1", "=>0.5"} {
+		if _, err := parseReleaseConstraint(invalid); err == nil {
+			t.Errorf("expected an error parsing %q", invalid)
+		}
+	}
+}
+
+func TestReleaseVersionCompare(t *testing.T) {
+	// Each version is lower than the next.
+	ordered := []string{
+		"0.4.9",
+		"0.5.0-alpha",
+		"0.5.0-alpha.1",
+		"0.5.0-alpha.beta",
+		"0.5.0-beta",
+		"0.5.0-beta.2",
+		"0.5.0-beta.11",
+		"0.5.0-rc.1",
+		"0.5.0-rc1",
+		"0.5.0",
+		"v0.5.1",
+		"0.5.10",
+		"0.6.0-rc1",
+		"0.6.0",
+		"1.0.0",
+	}
+	for i := range ordered {
+		for j := range ordered {
+			a, _ := parseReleaseVersion(ordered[i])
+			b, _ := parseReleaseVersion(ordered[j])
+			want := 0
+			if i < j {
+				want = -1
+			} else if i > j {
+				want = 1
+			}
+			if got := a.compare(b); got != want {
+				t.Errorf("compare(%q, %q) = %d, want %d", ordered[i], ordered[j], got, want)
+			}
+		}
+	}
+
+	equal := [][2]string{{"0.5", "0.5.0"}, {"v0.5.0", "0.5.0"}, {"0.5.0+build", "0.5.0"}}
+	for _, pair := range equal {
+		a, _ := parseReleaseVersion(pair[0])
+		b, _ := parseReleaseVersion(pair[1])
+		if got := a.compare(b); got != 0 {
+			t.Errorf("compare(%q, %q) = %d, want 0", pair[0], pair[1], got)
+		}
+	}
+}
+
+func TestCompareVersions(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{"2.28", "2.28", 0},
+		{"2.28", "2.28.0", 0},
+		{"2.27", "2.28", -1},
+		{"2.31", "2.28", 1},
+		{"2.9", "2.28", -1},
+		{"3", "2.28", 1},
+	}
+	for _, test := range tests {
+		if got := compareVersions(test.a, test.b); got != test.want {
+			t.Errorf("compareVersions(%q, %q) = %d, want %d", test.a, test.b, got, test.want)
+		}
+	}
+}
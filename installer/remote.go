@@ -0,0 +1,284 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"maps"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"time"
+)
+
+// The backends that can serve models to Open WebUI; see getBackend.
+const (
+	backendOllama   = "ollama"    // Ollama installed and run by the extension.
+	backendRemote   = "remote"    // An existing ollama server at remote.url.
+	backendLlamaCpp = "llama.cpp" // llama.cpp's llama-server, installed and run by the extension.
+)
+
+var knownBackends = []string{backendOllama, backendRemote, backendLlamaCpp}
+
+const (
+	remoteProxyLogName = "remote-proxy.log"
+	// How long the remote proxy waits for in-flight requests when stopped.
+	remoteProxyShutdownTimeout = 5 * time.Second
+	// The name of the proxy setting recording the remote server settings; see
+	// getRemoteProxySettings.
+	remoteDigestSetting = "REMOTE_SETTINGS_SHA256"
+)
+
+// remoteConfig describes the ollama server used by the remote backend.
+type remoteConfig struct {
+	URL   string `json:"url"`
+	Token string `json:"token"` // Sent as a bearer token, if set.
+}
+
+// remoteStatus describes the remote ollama server, as printed by ModeStatus.
+type remoteStatus struct {
+	URL       string   `json:"url"`
+	Reachable bool     `json:"reachable"`
+	Version   string   `json:"version,omitempty"`
+	Models    []string `json:"models"`
+	Error     string   `json:"error,omitempty"`
+	// ProxyRunning is set if the proxy serving the remote server on the ollama
+	// port, for Open WebUI, is responding.
+	ProxyRunning bool `json:"proxyRunning"`
+}
+
+// Check if the extension uses an existing ollama server rather than managing
+// its own.
+func isRemoteBackend() bool {
+	return config.Backend == backendRemote
+}
+
+// Check that the backend settings are valid.
+func validateBackend(c *installerConfig) error {
+	if !slices.Contains(knownBackends, c.Backend) {
+		return fmt.Errorf("unsupported backend %q; should be one of %v", c.Backend, knownBackends)
+	}
+	if c.Backend == backendLlamaCpp && c.LlamaCpp.Model == "" {
+		return fmt.Errorf("llamaCpp.model must be set to use the llama.cpp backend")
+	}
+	if c.Backend != backendRemote {
+		return nil
+	}
+	if c.Remote.URL == "" {
+		return fmt.Errorf("remote.url must be set to use the remote backend")
+	}
+	u, err := url.Parse(c.Remote.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("invalid remote.url %q: expected an http or https URL", c.Remote.URL)
+	}
+	return nil
+}
+
+// Get the base URL of the server for display, without any password.
+func getServerDisplayURL() string {
+	if u, err := url.Parse(getServerURL()); err == nil {
+		return u.Redacted()
+	}
+	return getServerURL()
+}
+
+// Query the version and models of the remote server.
+func probeRemote(ctx context.Context) *remoteStatus {
+	status := &remoteStatus{URL: getServerDisplayURL(), Models: []string{}}
+	log.Printf("Checking the remote ollama server at %s...", status.URL)
+	var err error
+	if status.Version, err = (ollamaBackend{}).version(ctx); err != nil {
+		status.Error = err.Error()
+		return status
+	}
+	if status.Models, err = (ollamaBackend{}).models(ctx); err != nil {
+		status.Models = []string{}
+		status.Error = err.Error()
+		return status
+	}
+	status.Reachable = true
+	log.Printf("Remote ollama server is running version %s with %d models.", status.Version, len(status.Models))
+	return status
+}
+
+// remoteBackend is an existing ollama server, not managed by the extension;
+// it uses the ollama API in the same way as ollamaBackend.  Open WebUI always
+// connects to the ollama port, so the installer runs a proxy there that
+// forwards requests to the remote server, adding its credentials.
+type remoteBackend struct {
+	ollamaBackend
+}
+
+func (remoteBackend) name() string {
+	return "remote ollama"
+}
+
+// There is no local executable for the remote server.
+func (remoteBackend) executable(ctx context.Context) string {
+	return ""
+}
+
+func (remoteBackend) install(ctx context.Context) error {
+	log.Printf("Using the remote ollama server at %s; there is nothing to install.", getServerDisplayURL())
+	return nil
+}
+
+// Check that the remote server can be used, and start the proxy to it unless
+// it is already running.
+func (remoteBackend) start(ctx context.Context) error {
+	status := probeRemote(ctx)
+	if !status.Reachable {
+		return fmt.Errorf("remote ollama server at %s is not usable: %s", status.URL, status.Error)
+	}
+	return startRemoteProxy(ctx)
+}
+
+// The remote server is never stopped; this stops the proxy to it, or a server
+// started before switching to the remote backend.
+func (remoteBackend) stop(ctx context.Context) (*shutdownReport, error) {
+	return terminateOwnedProcess(ctx)
+}
+
+// Check that the remote server responds to /api/version and /api/tags with the
+// configured credentials; the proxy is checked separately by printStatus.
+func (remoteBackend) health(ctx context.Context) (bool, error) {
+	return probeRemote(ctx).Reachable, nil
+}
+
+// Check if a server responds to ollama API requests on the ollama port.
+func isLocalServerRunning(ctx context.Context) bool {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, getLocalServerURL()+"/api/version", nil)
+	if err != nil {
+		return false
+	}
+	resp, err := doWithRetry(ctx, req, healthRetryPolicy)
+	if err != nil {
+		return false
+	}
+	resp.Body.Close()
+	return resp.StatusCode < 400
+}
+
+// Get the settings the remote proxy runs with, which are passed in its
+// environment and recorded in the PID file.  The proxy reads the remote server
+// settings from the config like the installer that started it; as the URL and
+// token are secret, only a digest of them is recorded, so that a proxy to a
+// different server can be detected.
+func getRemoteProxySettings() map[string]string {
+	digest := sha256.Sum256([]byte(config.Remote.URL + "\n" + config.Remote.Token))
+	return map[string]string{
+		configEnvPrefix + "BACKEND":      backendRemote,
+		configEnvPrefix + "PORTS_OLLAMA": strconv.Itoa(config.Ports.Ollama),
+		remoteDigestSetting:              hex.EncodeToString(digest[:]),
+	}
+}
+
+// Start the proxy to the remote server on the ollama port, as a detached
+// installer process, and wait for it to respond.  A proxy already running with
+// the same settings is reused; any other server started by the extension is
+// stopped first, as it holds the port.
+func startRemoteProxy(ctx context.Context) error {
+	executablePath, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("failed to find installer executable: %w", err)
+	}
+	settings := getRemoteProxySettings()
+	pidFile, err := readPIDFile(ctx)
+	if err != nil {
+		return err
+	}
+	if pidFile != nil && isOwnedServerRunning(pidFile) {
+		if pidFile.Executable == executablePath && maps.Equal(pidFile.Settings, settings) && isLocalServerRunning(ctx) {
+			log.Printf("The proxy to the remote server is already running.")
+			return nil
+		}
+		log.Printf("Stopping the server previously started by the extension...")
+		report, err := terminateOwnedProcess(ctx)
+		if err != nil {
+			return err
+		}
+		report.log()
+		removePIDFile(ctx)
+	}
+	if isLocalServerRunning(ctx) {
+		return fmt.Errorf("another server is already running on port %d; stop it so that Open WebUI can use the remote server", config.Ports.Ollama)
+	}
+	log.Printf("Starting the proxy to the remote server on port %d...", config.Ports.Ollama)
+	return runServer(ctx, remoteProxyLogName, executablePath, settings, getLocalServerURL()+"/api/version", string(ModeProxy))
+}
+
+// Create the handler forwarding requests to the remote server, with its
+// credentials.
+func newRemoteProxy() (*httputil.ReverseProxy, error) {
+	target, err := url.Parse(config.Remote.URL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid remote.url: %w", err)
+	}
+	transport := httpClient.Transport.(*http.Transport).Clone()
+	// Responses to requests that do not stream only start once the model has
+	// loaded and generated its answer, which may take a long time.
+	transport.ResponseHeaderTimeout = 0
+	return &httputil.ReverseProxy{
+		Rewrite: func(r *httputil.ProxyRequest) {
+			r.SetURL(target)
+			r.Out.Header.Del("Authorization")
+			if config.Remote.Token != "" {
+				r.Out.Header.Set("Authorization", "Bearer "+config.Remote.Token)
+			} else if target.User != nil {
+				password, _ := target.User.Password()
+				r.Out.SetBasicAuth(target.User.Username(), password)
+			}
+		},
+		Transport: transport,
+		// Pass on streamed responses as they arrive.
+		FlushInterval: -1,
+	}, nil
+}
+
+// Serve the remote server on the ollama port until the context is cancelled;
+// see ModeProxy.
+func serveRemoteProxy(ctx context.Context) error {
+	if !isRemoteBackend() {
+		return fmt.Errorf("the proxy is only used with the remote backend")
+	}
+	proxy, err := newRemoteProxy()
+	if err != nil {
+		return err
+	}
+	// Listen on the same address as the ollama server would.
+	listener, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", config.Ports.Ollama))
+	if err != nil {
+		return fmt.Errorf("failed to listen on port %d: %w", config.Ports.Ollama, err)
+	}
+	server := &http.Server{Handler: proxy, ReadHeaderTimeout: httpResponseHeaderTimeout}
+	errs := make(chan error, 1)
+	go func() {
+		errs <- server.Serve(listener)
+	}()
+	log.Printf("Serving %s on port %d.", getServerDisplayURL(), config.Ports.Ollama)
+
+	select {
+	case err = <-errs:
+		return fmt.Errorf("proxy failed: %w", err)
+	case <-ctx.Done():
+	}
+	log.Printf("Stopping the proxy...")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), remoteProxyShutdownTimeout)
+	defer cancel()
+	if err = server.Shutdown(shutdownCtx); err != nil && !errors.Is(err, context.DeadlineExceeded) {
+		return fmt.Errorf("failed to stop proxy: %w", err)
+	}
+	return nil
+}
+
+// Get the error for an operation that only applies to a managed install.
+func errRemoteBackend(operation string) error {
+	return fmt.Errorf("cannot %s: the remote backend uses an ollama server not managed by the extension", operation)
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"maps"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// serverSettingValidators lists the ollama server environment variables that
+// may be set in the config file, along with a function to validate each value.
+var serverSettingValidators = map[string]func(string) error{
+	"OLLAMA_KEEP_ALIVE":        validateKeepAlive,
+	"OLLAMA_NUM_PARALLEL":      validateIntAtLeast(1),
+	"OLLAMA_MAX_LOADED_MODELS": validateIntAtLeast(0),
+	"OLLAMA_CONTEXT_LENGTH":    validateIntAtLeast(1),
+	"OLLAMA_FLASH_ATTENTION":   validateBool,
+	"OLLAMA_ORIGINS":           validateOrigins,
+}
+
+// Get the names of the supported server settings, sorted.
+func knownServerSettings() []string {
+	names := make([]string, 0, len(serverSettingValidators))
+	for name := range serverSettingValidators {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+// Check that all server settings are known and have valid values.
+func validateServerSettings(settings map[string]string) error {
+	for name, value := range settings {
+		validate, ok := serverSettingValidators[name]
+		if !ok {
+			return fmt.Errorf("unsupported server setting %s; should be one of %v", name, knownServerSettings())
+		}
+		if err := validate(value); err != nil {
+			return fmt.Errorf("invalid server setting %s=%q: %w", name, value, err)
+		}
+	}
+	return nil
+}
+
+// The keep alive is either a duration ("5m") or a number of seconds; negative
+// values keep models loaded indefinitely.
+func validateKeepAlive(value string) error {
+	if _, err := strconv.Atoi(value); err == nil {
+		return nil
+	}
+	if _, err := time.ParseDuration(value); err != nil {
+		return fmt.Errorf("expected a duration or a number of seconds")
+	}
+	return nil
+}
+
+func validateIntAtLeast(minimum int) func(string) error {
+	return func(value string) error {
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("expected an integer")
+		}
+		if n < minimum {
+			return fmt.Errorf("must be at least %d", minimum)
+		}
+		return nil
+	}
+}
+
+func validateBool(value string) error {
+	if _, err := strconv.ParseBool(value); err != nil {
+		return fmt.Errorf("expected true or false")
+	}
+	return nil
+}
+
+func validateOrigins(value string) error {
+	for _, origin := range strings.Split(value, ",") {
+		if strings.TrimSpace(origin) == "" {
+			return fmt.Errorf("expected a comma-separated list of origins")
+		}
+	}
+	return nil
+}
+
+// Get the environment settings the ollama server should run with; this
+// includes the configured server settings, plus the listen address and the
+// models directory.
+func getServerSettings(modelsDir string) map[string]string {
+	settings := maps.Clone(config.Server)
+	if settings == nil {
+		settings = make(map[string]string)
+	}
+	settings["OLLAMA_HOST"] = fmt.Sprintf("127.0.0.1:%d", config.Ports.Ollama)
+	settings["OLLAMA_MODELS"] = modelsDir
+	return settings
+}
+
+// Get the environment for the ollama server process: our own environment, with
+// the given settings overriding any inherited values.
+func serverEnvironment(settings map[string]string) []string {
+	env := os.Environ()
+	for name, value := range settings {
+		env = append(env, name+"="+value)
+	}
+	return env
+}
+
+// Restart the ollama server started by the extension if the effective server
+// settings differ from the ones it is running with.  Prints a JSON result.
+func applyServerSettings(ctx context.Context) error {
+	result := struct {
+		Running   bool `json:"running"`
+		Restarted bool `json:"restarted"`
+	}{}
+
+	if config.Backend != backendOllama {
+		log.Printf("Server settings only apply to the ollama server run by the extension.")
+		if err := json.NewEncoder(os.Stdout).Encode(result); err != nil {
+			return fmt.Errorf("failed to output result: %w", err)
+		}
+		return nil
+	}
+	pidFile, err := readPIDFile(ctx)
+	if err != nil {
+		return err
+	}
+	modelsDir, err := getModelsLocation(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to find models directory: %w", err)
+	}
+	settings := getServerSettings(modelsDir)
+	if pidFile != nil && isOwnedServerRunning(pidFile) {
+		result.Running = true
+		if maps.Equal(pidFile.Settings, settings) {
+			log.Printf("Server settings are unchanged.")
+		} else {
+			log.Printf("Server settings have changed; restarting ollama...")
+			report, err := terminateOwnedProcess(ctx)
+			if err != nil {
+				return err
+			}
+			report.log()
+			removePIDFile(ctx)
+			if err = startServer(ctx, pidFile.Executable); err != nil {
+				return err
+			}
+			result.Restarted = true
+		}
+	} else {
+		log.Printf("Ollama is not running; settings will be applied when it is started.")
+	}
+
+	if err = json.NewEncoder(os.Stdout).Encode(result); err != nil {
+		return fmt.Errorf("failed to output result: %w", err)
+	}
+	return nil
+}
+
+// Check whether the server recorded in the PID file is still running.
+func isOwnedServerRunning(pidFile *serverPIDFile) bool {
+	startTime, err := getProcessStartTime(pidFile.PID)
+	return err == nil && startTime == pidFile.StartTime && isProcessRunning(pidFile.PID)
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// installStatus is the output of ModeStatus.
+type installStatus struct {
+	Backend    string `json:"backend"`
+	Installed  bool   `json:"installed"`
+	Executable string `json:"executable,omitempty"`
+	// Version is from the install receipt if ollama was installed by the
+	// extension, and otherwise as reported by the backend.
+	Version string `json:"version,omitempty"`
+	Running bool   `json:"running"`
+	// Managed is set if the running server was started by the extension.
+	Managed bool         `json:"managed"`
+	PID     int          `json:"pid,omitempty"`
+	Models  modelsStatus `json:"models"`
+	Pull    *pullState   `json:"pull"`
+	// ServerModels lists the models offered by the running server.
+	ServerModels []string `json:"serverModels,omitempty"`
+	// Remote describes the server used by the remote backend.
+	Remote *remoteStatus `json:"remote,omitempty"`
+}
+
+type modelsStatus struct {
+	Path string `json:"path"`
+	Size int64  `json:"size"` // In bytes.
+}
+
+// Print the status of the install, the server, and the models directory.  With
+// the remote backend, the remote server and the proxy to it are checked
+// instead.
+func printStatus(ctx context.Context) error {
+	status := installStatus{Backend: config.Backend}
+	var err error
+
+	if isRemoteBackend() {
+		status.Remote = probeRemote(ctx)
+		status.Remote.ProxyRunning = isLocalServerRunning(ctx)
+		status.Installed, status.Running = status.Remote.Reachable, status.Remote.Reachable
+		status.Managed, status.PID = getManagedServer(ctx)
+	} else if err = getLocalStatus(ctx, getBackend(), &status); err != nil {
+		return err
+	}
+	if status.Pull, err = readPullState(ctx); err != nil {
+		return err
+	}
+
+	if err = json.NewEncoder(os.Stdout).Encode(status); err != nil {
+		return fmt.Errorf("failed to output status: %w", err)
+	}
+	return nil
+}
+
+// Fill in the status of the backend installed by the extension, its server,
+// and the models directory.
+func getLocalStatus(ctx context.Context, b backend, status *installStatus) error {
+	var err error
+	status.Executable = b.executable(ctx)
+	status.Installed = status.Executable != ""
+	if config.Backend == backendOllama {
+		if receipt, err := readInstallReceipt(ctx); err != nil {
+			return err
+		} else if receipt != nil && status.Installed {
+			status.Version = receipt.Version
+		}
+	}
+	if status.Running, err = b.health(ctx); err != nil {
+		return err
+	}
+	if status.Version == "" && (status.Installed || status.Running) {
+		if status.Version, err = b.version(ctx); err != nil {
+			log.Printf("Failed to get %s version: %s", b.name(), err)
+		}
+	}
+	if status.Running {
+		if status.ServerModels, err = b.models(ctx); err != nil {
+			log.Printf("Failed to list models of the %s server: %s", b.name(), err)
+		}
+	}
+	status.Managed, status.PID = getManagedServer(ctx)
+	if status.Models.Path, err = getModelsLocation(ctx); err != nil {
+		return fmt.Errorf("failed to find models directory: %w", err)
+	}
+	if status.Models.Size, err = directorySize(status.Models.Path); err != nil {
+		return fmt.Errorf("failed to get size of models directory: %w", err)
+	}
+	return nil
+}
+
+// Get the total size of the regular files in the given directory, counting
+// files that are linked more than once only once.  A missing directory has a
+// size of zero.
+func directorySize(root string) (int64, error) {
+	var size int64
+	var seen []os.FileInfo
+	err := filepath.WalkDir(root, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if !entry.Type().IsRegular() {
+			return nil
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		if isHardLinked(info) {
+			for _, other := range seen {
+				if os.SameFile(info, other) {
+					return nil
+				}
+			}
+			seen = append(seen, info)
+		}
+		size += info.Size()
+		return nil
+	})
+	return size, err
+}
+
+// Check if the server recorded in the PID file is running, returning its PID.
+func getManagedServer(ctx context.Context) (bool, int) {
+	if pidFile, err := readPIDFile(ctx); err == nil && pidFile != nil && isOwnedServerRunning(pidFile) {
+		return true, pidFile.PID
+	}
+	return false, 0
+}
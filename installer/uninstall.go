@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// Categories of data removed on uninstall.
+const (
+	uninstallInstall = "install" // The ollama and llama.cpp installs and runtime state; always removed.
+	uninstallModels  = "models"
+	uninstallCache   = "cache"
+	uninstallLogs    = "logs"
+	uninstallConfig  = "config"
+)
+
+var (
+	purgeModels bool
+	purgeCache  bool
+	purgeLogs   bool
+	purgeConfig bool
+	dryRun      bool
+)
+
+// Register the flags used when uninstalling.
+func uninstallFlags(flags *flag.FlagSet) {
+	flags.BoolVar(&purgeModels, "purge-models", false, "when uninstalling, also delete downloaded models")
+	flags.BoolVar(&purgeCache, "purge-cache", false, "when uninstalling, also delete cached downloads")
+	flags.BoolVar(&purgeLogs, "purge-logs", false, "when uninstalling, also delete log files")
+	flags.BoolVar(&purgeConfig, "purge-config", false, "when uninstalling, also delete the per-user config file")
+	flags.BoolVar(&dryRun, "dry-run", false, "when uninstalling, only report what would be deleted")
+	flags.StringVar(&exportModels, "export-models", "", "when uninstalling, first copy the managed models into this ollama models directory")
+}
+
+// uninstallItem is a file or directory considered for deletion on uninstall.
+type uninstallItem struct {
+	Category string `json:"category"`
+	Path     string `json:"path"`
+	Size     int64  `json:"size"` // In bytes.
+	Delete   bool   `json:"delete"`
+	Deleted  bool   `json:"deleted"`
+	Error    string `json:"error,omitempty"`
+}
+
+// uninstallReport is the output of ModeUninstall.
+type uninstallReport struct {
+	DryRun bool            `json:"dryRun"`
+	Items  []uninstallItem `json:"items"`
+	Freed  int64           `json:"freed"` // In bytes.
+	// Exported describes the models copied out by -export-models, if any.
+	Exported *modelsTransfer `json:"exported,omitempty"`
+}
+
+// Uninstall ollama, along with any other data selected by the purge flags,
+// and print a JSON report of what was (or would be) deleted.  With the remote
+// backend no files are deleted, but the proxy to the remote server is stopped.
+func uninstall(ctx context.Context) error {
+	if isRemoteBackend() {
+		log.Printf("Using the remote ollama server at %s; there is nothing to uninstall.", getServerDisplayURL())
+		if !dryRun {
+			report, err := terminateOwnedProcess(ctx)
+			if err != nil {
+				return err
+			}
+			report.log()
+			removePIDFile(ctx)
+		}
+		if err := json.NewEncoder(os.Stdout).Encode(uninstallReport{DryRun: dryRun, Items: []uninstallItem{}}); err != nil {
+			return fmt.Errorf("failed to output uninstall report: %w", err)
+		}
+		return nil
+	}
+	items, err := planUninstall(ctx)
+	if err != nil {
+		return err
+	}
+	report := uninstallReport{DryRun: dryRun, Items: items}
+
+	if exportModels != "" {
+		modelsDir, err := getModelsLocation(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to find models directory: %w", err)
+		}
+		if dryRun {
+			log.Printf("Would copy models from %s to %s", modelsDir, exportModels)
+		} else {
+			// Abort the uninstall if this fails, so no models are lost.
+			transfer, err := transferModels(ctx, modelsDir, exportModels)
+			if err != nil {
+				return fmt.Errorf("failed to export models: %w", err)
+			}
+			report.Exported = transfer
+		}
+	}
+
+	if !dryRun {
+		// These also stop any running processes.
+		installErr := errors.Join(uninstallOllama(ctx), stopLlamaCppProcesses(ctx))
+		removePIDFile(ctx)
+		for i := range report.Items {
+			item := &report.Items[i]
+			if !item.Delete {
+				continue
+			}
+			if item.Category == uninstallInstall && installErr != nil {
+				item.Error = installErr.Error()
+				continue
+			}
+			// The install itself has already been removed by this point.
+			if err := os.RemoveAll(item.Path); err != nil && !errors.Is(err, os.ErrNotExist) {
+				item.Error = err.Error()
+				continue
+			}
+			item.Deleted = true
+			report.Freed += item.Size
+		}
+	}
+
+	for _, item := range report.Items {
+		switch {
+		case item.Error != "":
+			log.Printf("Failed to delete %s (%s): %s", item.Path, item.Category, item.Error)
+		case item.Deleted:
+			log.Printf("Deleted %s (%s, %d bytes)", item.Path, item.Category, item.Size)
+		case item.Delete:
+			log.Printf("Would delete %s (%s, %d bytes)", item.Path, item.Category, item.Size)
+		default:
+			log.Printf("Keeping %s (%s, %d bytes)", item.Path, item.Category, item.Size)
+		}
+	}
+	if !dryRun {
+		log.Printf("Freed %d bytes.", report.Freed)
+	}
+	if err = json.NewEncoder(os.Stdout).Encode(report); err != nil {
+		return fmt.Errorf("failed to output uninstall report: %w", err)
+	}
+	for _, item := range report.Items {
+		if item.Error != "" {
+			return fmt.Errorf("failed to delete %s", item.Path)
+		}
+	}
+	return nil
+}
+
+// Determine what would be deleted on uninstall.  Only paths that exist are
+// included.
+func planUninstall(ctx context.Context) ([]uninstallItem, error) {
+	type candidate struct {
+		category string
+		delete   bool
+		getPath  func(context.Context) (string, error)
+	}
+	stateFile := func(name string) func(context.Context) (string, error) {
+		return func(ctx context.Context) (string, error) {
+			stateDir, err := getStateLocation(ctx)
+			return filepath.Join(stateDir, name), err
+		}
+	}
+	candidates := []candidate{
+		{uninstallInstall, true, getDefaultInstallLocation},
+		{uninstallInstall, true, getLlamaCppInstallLocation},
+		{uninstallInstall, true, stateFile(pullStateFileName)},
+		{uninstallInstall, true, stateFile(receiptFileName)},
+		{uninstallInstall, true, stateFile(updateCheckFileName)},
+		{uninstallModels, purgeModels, getModelsLocation},
+		{uninstallCache, purgeCache, getCacheLocation},
+		{uninstallLogs, purgeLogs, getLogLocation},
+		{uninstallConfig, purgeConfig, func(context.Context) (string, error) { return getUserConfigFile() }},
+	}
+
+	var items []uninstallItem
+	for _, c := range candidates {
+		path, err := c.getPath(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to find %s location: %w", c.category, err)
+		}
+		if _, err = os.Lstat(path); err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				continue
+			}
+			return nil, fmt.Errorf("failed to examine %s: %w", path, err)
+		}
+		size, err := directorySize(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get size of %s: %w", path, err)
+		}
+		item := uninstallItem{Category: c.category, Path: path, Size: size, Delete: c.delete}
+		if c.category == uninstallModels && item.Delete && isModelsDirShared(path) {
+			// The models belong to another ollama install; never delete them.
+			log.Printf("Models directory %s is shared with another install; not deleting it.", path)
+			item.Delete = false
+		}
+		items = append(items, item)
+	}
+	return items, nil
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	updateCheckFileName = "update-check.json"
+	// How often to check for updates, unless -refresh is given.
+	updateCheckInterval = 24 * time.Hour
+)
+
+var refreshUpdateCheck bool
+
+// Register the flags used when checking for updates.
+func updateCheckFlags(flags *flag.FlagSet) {
+	flags.BoolVar(&refreshUpdateCheck, "refresh", false, "check for updates even if the last check was less than a day ago")
+}
+
+// Words in release notes that mark a release as fixing security issues.
+var securityKeywords = []string{"security", "cve-", "vulnerab"}
+
+// updateCheckResult is the output of ModeUpdateCheck, also recorded in the
+// state directory to limit how often releases are checked.
+type updateCheckResult struct {
+	Current   string `json:"current"`             // The installed version.
+	Available string `json:"available,omitempty"` // The newest release matching the release setting.
+	Update    bool   `json:"updateAvailable"`
+	NotesURL  string `json:"notesURL,omitempty"` // Release notes of the available release.
+	// Security is set if any release after the installed one mentions
+	// security fixes in its notes.
+	Security bool      `json:"security"`
+	Release  string    `json:"release"` // The release setting checked against.
+	Checked  time.Time `json:"checked"`
+}
+
+func getUpdateCheckPath(ctx context.Context) (string, error) {
+	stateDir, err := getStateLocation(ctx)
+	if err != nil {
+		return "", fmt.Errorf("failed to find state directory: %w", err)
+	}
+	return filepath.Join(stateDir, updateCheckFileName), nil
+}
+
+// Read the result of the last update check; returns nil if there is none.
+func readUpdateCheck(path string) (*updateCheckResult, error) {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to read last update check: %w", err)
+	}
+	var result updateCheckResult
+	if err = json.Unmarshal(buf, &result); err != nil {
+		// Just check again.
+		log.Printf("Ignoring invalid update check state: %s", err)
+		return nil, nil
+	}
+	return &result, nil
+}
+
+// Check if the release notes mention security fixes.
+func mentionsSecurity(notes string) bool {
+	notes = strings.ToLower(notes)
+	for _, keyword := range securityKeywords {
+		if strings.Contains(notes, keyword) {
+			return true
+		}
+	}
+	return false
+}
+
+// Compare the installed version against the newest release matching the
+// release setting.
+func checkForUpdate(ctx context.Context, current string) (*updateCheckResult, error) {
+	result := &updateCheckResult{Current: current, Release: config.Release, Checked: time.Now().UTC()}
+	currentVersion, ok := parseReleaseVersion(current)
+	if !ok {
+		return nil, fmt.Errorf("failed to parse installed version %q", current)
+	}
+	releases, err := listReleases(ctx)
+	if err != nil {
+		return nil, err
+	}
+	assetName := getOllamaAssetName()
+	var available *listedRelease
+	if isReleaseConstraint(config.Release) || config.Release == releaseLatest {
+		if available, err = selectRelease(releases, config.Release, assetName); err != nil {
+			return nil, err
+		}
+	} else {
+		// An exact tag; an update is only available if it has been changed.
+		for i := range releases {
+			if releases[i].TagName == config.Release {
+				available = &releases[i]
+			}
+		}
+		if available == nil {
+			return nil, fmt.Errorf("failed to find release %q", config.Release)
+		}
+	}
+	availableVersion, _ := parseReleaseVersion(available.TagName)
+	result.Available = available.TagName
+	result.NotesURL = available.HTMLURL
+	result.Update = availableVersion.compare(currentVersion) > 0
+	if result.Update {
+		for _, release := range releases {
+			version, ok := parseReleaseVersion(release.TagName)
+			if ok && version.compare(currentVersion) > 0 && version.compare(availableVersion) <= 0 && mentionsSecurity(release.Body) {
+				result.Security = true
+			}
+		}
+	}
+	return result, nil
+}
+
+// Check if a newer release is available than the installed one, printing the
+// result as JSON.  Releases are checked at most once a day; otherwise the
+// result of the last check is printed.
+func printUpdateCheck(ctx context.Context) error {
+	receipt, err := readInstallReceipt(ctx)
+	if err != nil {
+		return err
+	}
+	if receipt == nil {
+		return fmt.Errorf("no install receipt found; ollama was not installed by this installer")
+	}
+	current := receipt.Version
+	if current == "" {
+		// Receipts written before versions were recorded.
+		current = receipt.Release
+	}
+
+	statePath, err := getUpdateCheckPath(ctx)
+	if err != nil {
+		return err
+	}
+	result, err := readUpdateCheck(statePath)
+	if err != nil {
+		return err
+	}
+	if result != nil && !refreshUpdateCheck && result.Current == current && result.Release == config.Release && time.Since(result.Checked) < updateCheckInterval {
+		log.Printf("Last checked for updates at %s.", result.Checked.Local().Format(time.RFC1123))
+	} else {
+		if result, err = checkForUpdate(ctx, current); err != nil {
+			return fmt.Errorf("failed to check for updates: %w", err)
+		}
+		buf, err := json.MarshalIndent(result, "", "  ")
+		if err != nil {
+			return fmt.Errorf("failed to serialize update check: %w", err)
+		}
+		if err = os.MkdirAll(filepath.Dir(statePath), 0o755); err != nil {
+			return fmt.Errorf("failed to create state directory: %w", err)
+		}
+		if err = os.WriteFile(statePath, buf, 0o644); err != nil {
+			return fmt.Errorf("failed to record update check: %w", err)
+		}
+	}
+	if result.Update {
+		log.Printf("Ollama %s is available (installed: %s).", result.Available, result.Current)
+	}
+	if err = json.NewEncoder(os.Stdout).Encode(result); err != nil {
+		return fmt.Errorf("failed to output update check: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strings"
+	"time"
+)
+
+const (
+	// How long to keep trying to run a newly installed executable, which may
+	// be locked while virus scanners check it.
+	validateTimeout = 60 * time.Second
+	// How long to wait for each attempt to run the executable.
+	validateAttemptTimeout = 15 * time.Second
+)
+
+// Windows status codes for executables that cannot be loaded.
+const (
+	statusDLLNotFound        = 0xC0000135
+	statusInvalidImageFormat = 0xC000007B
+)
+
+// Output from the dynamic loader when libraries are missing, for glibc, musl
+// and macOS respectively.
+var missingLibraryMessages = []string{
+	"error while loading shared libraries",
+	"Error loading shared library",
+	"Error relocating",
+	"Library not loaded",
+}
+
+// Matches the version in the output of `ollama --version`; this reports the
+// server version if one is running, and the client version if it differs.
+var ollamaVersionPattern = regexp.MustCompile(`(?m)version is v?(\d[^\s]*)\s*$`)
+
+// Matches the build number in the output of `llama-server --version`, e.g.
+// "version: 6710 (74b8fc17)".
+var llamaServerVersionPattern = regexp.MustCompile(`(?m)^version: (\d+)`)
+
+// Parse the output of `ollama --version`; returns the version of the client
+// (i.e. the executable that was run).
+func parseOllamaVersion(output string) (string, error) {
+	matches := ollamaVersionPattern.FindAllStringSubmatch(output, -1)
+	if len(matches) == 0 {
+		return "", fmt.Errorf("no version found in %q", strings.TrimSpace(output))
+	}
+	return matches[len(matches)-1][1], nil
+}
+
+// Parse the output of `llama-server --version`; returns the release tag of
+// the build, e.g. "b6710".
+func parseLlamaServerVersion(output string) (string, error) {
+	match := llamaServerVersionPattern.FindStringSubmatch(output)
+	if match == nil {
+		return "", fmt.Errorf("no version found in %q", firstLine(output))
+	}
+	return "b" + match[1], nil
+}
+
+// Check if an error running the executable means it can never run on this
+// machine, rather than that it is temporarily locked; returns a description
+// of the problem if so.
+func diagnoseExecFailure(executablePath string, err error, output string) string {
+	for _, message := range missingLibraryMessages {
+		if strings.Contains(output, message) {
+			return "it needs libraries that are not installed: " + firstLine(output)
+		}
+	}
+	if strings.Contains(output, "GLIBC_") {
+		return "it needs a newer version of glibc: " + firstLine(output)
+	}
+	message := err.Error()
+	switch {
+	case strings.Contains(message, "exec format error"),
+		strings.Contains(message, "bad CPU type"),
+		strings.Contains(message, "not a valid Win32 application"):
+		return fmt.Sprintf("it was not built for this machine (%s/%s)", runtime.GOOS, runtime.GOARCH)
+	case errors.Is(err, fs.ErrNotExist):
+		// The executable exists, so it is its dynamic loader that is missing;
+		// e.g. a glibc executable on a musl system.
+		if _, statErr := os.Stat(executablePath); statErr == nil {
+			return "its dynamic loader is missing; it requires glibc"
+		}
+	}
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		switch uint32(exitErr.ExitCode()) {
+		case statusDLLNotFound:
+			return "it needs DLLs that are not installed"
+		case statusInvalidImageFormat:
+			return fmt.Sprintf("it was not built for this machine (%s/%s)", runtime.GOOS, runtime.GOARCH)
+		}
+	}
+	return ""
+}
+
+func firstLine(s string) string {
+	line, _, _ := strings.Cut(strings.TrimSpace(s), "\n")
+	return line
+}
+
+// Run the installed executable with --version to check that it works,
+// returning the version parsed from its output.  Failures are retried for a
+// while, in case virus scanners have locked the executable, unless it can
+// never run on this machine.
+func validateExecutable(ctx context.Context, executablePath string, parseVersion func(output string) (string, error)) (string, error) {
+	name := strings.TrimSuffix(filepath.Base(executablePath), ".exe")
+	deadline := time.Now().Add(validateTimeout)
+	for attempt := 1; ; attempt++ {
+		output, err := func() ([]byte, error) {
+			ctx, cancel := context.WithTimeout(ctx, validateAttemptTimeout)
+			defer cancel()
+			return exec.CommandContext(ctx, executablePath, "--version").CombinedOutput()
+		}()
+		if err == nil {
+			version, err := parseVersion(string(output))
+			if err != nil {
+				return "", fmt.Errorf("failed to get %s version: %w", name, err)
+			}
+			return version, nil
+		}
+		if ctx.Err() != nil {
+			return "", ctx.Err()
+		}
+		if problem := diagnoseExecFailure(executablePath, err, string(output)); problem != "" {
+			return "", fmt.Errorf("%s at %s cannot run: %s", name, executablePath, problem)
+		}
+		if time.Now().After(deadline) {
+			if line := firstLine(string(output)); line != "" {
+				err = fmt.Errorf("%w: %s", err, line)
+			}
+			return "", fmt.Errorf("failed to run %s at %s after %d attempts: %w", name, executablePath, attempt, err)
+		}
+		log.Printf("Failed to run %s (%s); retrying...", executablePath, err)
+		select {
+		case <-ctx.Done():
+			return "", ctx.Err()
+		case <-time.After(time.Second):
+		}
+	}
+}
@@ -1,9 +1,10 @@
-import { useState, useEffect } from 'react';
+import { useState, useEffect, useRef } from 'react';
 import { createDockerDesktopClient } from '@docker/extension-api-client';
 import WebpageFrame from './WebpageFrame';
 import InstallView from './InstallView';
 import LoadingView from './LoadingView';
 import ToastNotification from './ToastNotification';
+import PullBanner, { PullStatus } from './PullBanner';
 
 const ddClient = createDockerDesktopClient();
 
@@ -13,6 +14,8 @@ export function App() {
   const [installing, setInstalling] = useState(false);
   const [installed, setInstalled] = useState(false);
   const [started, setStarted] = useState(false);
+  const [pull, setPull] = useState<PullStatus | null>(null);
+  const cancelling = useRef(false);
   const executable = `installer${ddClient.host.platform === 'win32' ? '.exe' : ''}`;
 
   async function runInstaller(...args: string[]) {
@@ -52,6 +55,28 @@ export function App() {
         stderr.trim() && console.error(stderr.trimEnd());
         stdout.trim() && console.debug(stdout.trimEnd());
         setInstalled(true);
+      } catch (ex) {
+        if (cancelling.current) {
+          // The install was cancelled; offer to install again.
+          cancelling.current = false;
+          setInstalling(false);
+          return;
+        }
+        console.error(ex);
+        setError(`${ex}`);
+      }
+    })();
+  }
+
+  // Callback for <LoadingView> to cancel an in-progress install.
+  function cancel() {
+    (async () => {
+      try {
+        console.log(`Cancelling install...`);
+        cancelling.current = true;
+        const { stdout, stderr } = await runInstaller('--mode=cancel');
+        stderr.trim() && console.error(stderr.trimEnd());
+        stdout.trim() && console.debug(stdout.trimEnd());
       } catch (ex) {
         console.error(ex);
         setError(`${ex}`);
@@ -76,13 +101,37 @@ export function App() {
     })();
   }, [installed]);
 
+  // Once started, the default model is pulled in the background; poll its
+  // status so we can show a banner while it downloads.
+  useEffect(() => {
+    if (!started) {
+      return;
+    }
+    let timer: ReturnType<typeof setTimeout> | undefined;
+    async function poll() {
+      try {
+        const { stdout, stderr } = await runInstaller('--mode=pull-status');
+        stderr.trim() && console.error(stderr.trimEnd());
+        const status: PullStatus | null = JSON.parse(stdout);
+        setPull(status);
+        if (status?.status === 'pending' || status?.status === 'running') {
+          timer = setTimeout(poll, 2000);
+        }
+      } catch (ex) {
+        console.error(ex);
+      }
+    }
+    poll();
+    return () => clearTimeout(timer);
+  }, [started]);
+
   return (
     <>
       {
         !!error ? <div className="error">{error}</div> :
           !installed && !installing && checked ? <InstallView install={install} /> :
-            !started ? <LoadingView /> :
-              <WebpageFrame />
+            !started ? <LoadingView cancel={installing && !installed ? cancel : undefined} /> :
+              <><PullBanner pull={pull} /><WebpageFrame /></>
       }
       <ToastNotification />
     </>
@@ -1,8 +1,13 @@
 import { FadeLoader } from "react-spinners";
 import './LoaderComponent.css';
 
-export default function LoadingView() {
+type LoadingViewProps = {
+    cancel?: () => void;
+}
+
+export default function LoadingView({ cancel }: LoadingViewProps = {}) {
     return <div className="loading-container">
         <FadeLoader color="#265277" />
+        {cancel && <button className="cancel-button" onClick={cancel}>Cancel</button>}
     </div>;
 }
@@ -0,0 +1,31 @@
+import './PullBanner.css';
+
+export type PullStatus = {
+    model: string;
+    status: 'pending' | 'running' | 'succeeded' | 'failed' | 'cancelled';
+    detail?: string;
+    completed: number;
+    total: number;
+    error?: string;
+}
+
+type PullBannerProps = {
+    pull: PullStatus | null;
+}
+
+export default function PullBanner({ pull }: PullBannerProps) {
+    if (!pull) {
+        return null;
+    }
+    switch (pull.status) {
+        case 'pending':
+        case 'running': {
+            const percent = pull.total > 0 ? ` (${Math.floor(100 * pull.completed / pull.total)}%)` : '';
+            return <div className="pull-banner">Model {pull.model} is downloading{percent}…</div>;
+        }
+        case 'failed':
+            return <div className="pull-banner pull-banner-error">Failed to download model {pull.model}: {pull.error}</div>;
+        default:
+            return null;
+    }
+}